@@ -1,6 +1,8 @@
 package application
 
 import (
+	"time"
+
 	"github.com/seapvnk/qokl/core"
 	"github.com/seapvnk/qokl/server"
 	"github.com/seapvnk/qokl/storage"
@@ -52,3 +54,70 @@ func (app *Application) CloseMemory() {
 	core.CloseStore()
 	storage.CloseDB()
 }
+
+// RotateKey re-encrypts the entity storage and the persistent core store with the key stored in newKeyFile,
+// the current key is read from the environment. The database must be closed.
+func RotateKey(baseDir, newKeyFile string) error {
+	oldKey, err := storage.LoadEncryptionKey()
+	if err != nil {
+		return err
+	}
+
+	newKey, err := storage.ReadKeyFile(newKeyFile)
+	if err != nil {
+		return err
+	}
+
+	dirs, err := databaseDirs(baseDir)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := storage.RotateKey(dir, oldKey, newKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compact flattens the entity storage and the persistent core store and reclaims value
+// log space, returns the bytes reclaimed. The databases must be closed.
+func Compact(baseDir string) (int64, error) {
+	dirs, err := databaseDirs(baseDir)
+	if err != nil {
+		return 0, err
+	}
+
+	total := int64(0)
+	for _, dir := range dirs {
+		reclaimed, err := storage.Compact(dir)
+		if err != nil {
+			return total, err
+		}
+		total += reclaimed
+	}
+
+	return total, nil
+}
+
+// Schedules lists the cron scheduled tasks with their next runs
+func Schedules(baseDir string) ([]tasks.Schedule, error) {
+	return tasks.Schedules(baseDir, time.Now())
+}
+
+// databaseDirs list the entity storage and, when persistent, the core store
+func databaseDirs(baseDir string) ([]string, error) {
+	storagePath, err := storage.StoragePath(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []string{storagePath}
+	if path := core.StorePath(); path != "" {
+		dirs = append(dirs, path)
+	}
+
+	return dirs, nil
+}
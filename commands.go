@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/seapvnk/qokl/application"
+)
+
+// runCommand executes maintenance commands, returns false when args are not a command
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case "rotate-key":
+		rotateKey(args[1:])
+	case "compact":
+		compact(args[1:])
+	case "schedules":
+		schedules(args[1:])
+	default:
+		return false
+	}
+
+	return true
+}
+
+// qokl rotate-key [baseDir] newKeyFile
+func rotateKey(args []string) {
+	baseDir := "./"
+	if len(args) == 2 {
+		baseDir = args[0]
+		args = args[1:]
+	}
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: qokl rotate-key [baseDir] newKeyFile")
+		os.Exit(2)
+	}
+
+	if err := application.RotateKey(baseDir, args[0]); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("encryption key rotated, update QOKL_ENCRYPTION_KEY or QOKL_ENCRYPTION_KEY_FILE before restarting")
+}
+
+// qokl compact [baseDir]
+func compact(args []string) {
+	baseDir := "./"
+	if len(args) == 1 {
+		baseDir = args[0]
+	}
+
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: qokl compact [baseDir]")
+		os.Exit(2)
+	}
+
+	reclaimed, err := application.Compact(baseDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("storage compacted, %d bytes reclaimed", reclaimed)
+}
+
+// qokl schedules [baseDir]
+func schedules(args []string) {
+	baseDir := "./"
+	if len(args) == 1 {
+		baseDir = args[0]
+	}
+
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: qokl schedules [baseDir]")
+		os.Exit(2)
+	}
+
+	schedules, err := application.Schedules(baseDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, schedule := range schedules {
+		fmt.Printf("%s (%s)\n", schedule.Task, schedule.Cron)
+		for _, next := range schedule.Next {
+			fmt.Printf("  %s\n", next.Format(time.RFC3339Nano))
+		}
+	}
+}
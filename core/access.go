@@ -0,0 +1,22 @@
+package core
+
+import (
+	"github.com/seapvnk/qokl/parser"
+	"github.com/seapvnk/qokl/storage"
+)
+
+// SetPrincipal enforces entity access rules for principal on the VM and binds it to `principal`
+func (vm *VM) SetPrincipal(principal map[string]any) *VM {
+	vm.environment.AddGlobal("principal", parser.ToSexp(vm.environment, principal))
+	vm.release = append(vm.release, storage.BindPrincipal(vm.environment, principal))
+
+	return vm
+}
+
+// Close releases the bindings of the VM, it must not be used afterwards
+func (vm *VM) Close() {
+	for _, release := range vm.release {
+		release()
+	}
+	vm.release = nil
+}
@@ -0,0 +1,28 @@
+package core
+
+import "time"
+
+const (
+	// directory of a persistent core store, queues and cache are in memory when unset
+	coreStoreEnv = "QOKL_CORE_STORE"
+)
+
+const (
+	// waiting this long raises a queued message by one priority point
+	priorityAging = 10 * time.Second
+
+	// messages listed by listQueue when no limit is given
+	defaultListLimit = 100
+
+	// how long the status of a job is kept after its last change
+	jobStatusTTL = 24 * time.Hour
+	// how long a workflow is kept after its last change
+	workflowTTL = 7 * 24 * time.Hour
+	// tries of a transaction that conflicts with a concurrent one
+	conflictRetries = 32
+	// messages purged, moved, recovered or promoted per transaction
+	queueBatchSize = 512
+	// delay before a failed outbox relay is tried again, doubled on each failure up to the max
+	outboxRetryDelay    = time.Second
+	outboxMaxRetryDelay = time.Minute
+)
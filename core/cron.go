@@ -0,0 +1,89 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+)
+
+func cronKey(name, label string) []byte {
+	return []byte(fmt.Sprintf("cron.%s.%s", name, label))
+}
+
+// StoreCronLast returns the last slot of a cron schedule, false when it never ran
+func StoreCronLast(queueName string) (time.Time, bool, error) {
+	var last time.Time
+	found := false
+
+	err := store.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(cronKey(queueName, "last"))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		found = true
+		return last.UnmarshalBinary(value)
+	})
+
+	return last, found, err
+}
+
+// StoreCronTrigger records slot as the last of a cron schedule, queuing a job for it when run is true.
+// A job is not queued while the previous one of the schedule is still pending, returns whether it was.
+func StoreCronTrigger(queueName string, slot time.Time, run bool) (bool, error) {
+	queued := false
+
+	err := store.Update(func(txn *badger.Txn) error {
+		last, err := slot.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		if err := txn.Set(cronKey(queueName, "last"), last); err != nil {
+			return err
+		}
+
+		if !run {
+			return nil
+		}
+
+		if _, err := txn.Get(cronKey(queueName, "active")); err == nil {
+			return nil
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		if err := txn.Set(cronKey(queueName, "active"), []byte("1")); err != nil {
+			return err
+		}
+
+		queued = true
+		return enqueue(txn, envelope{ID: uuid.NewString(), Queue: queueName, Msg: []byte{}, ScheduledAt: slot})
+	})
+	if err == nil && queued {
+		notifyQueued()
+	}
+
+	return queued, err
+}
+
+// cronDone allows the next job of a cron schedule to be queued once a job it queued is done
+func cronDone(txn *badger.Txn, queueName string, scheduledAt time.Time) error {
+	if scheduledAt.IsZero() {
+		return nil
+	}
+
+	return txn.Delete(cronKey(queueName, "active"))
+}
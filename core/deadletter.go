@@ -0,0 +1,109 @@
+package core
+
+import (
+	"errors"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+// fnDeadLetters lists the jobs of a queue that ran out of attempts
+// Lisp: (deadLetters aQueue:)
+func fnDeadLetters(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 1 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	queueName, ok := args[0].(*zygo.SexpSymbol)
+	if !ok {
+		return zygo.SexpNull, errors.New("deadLetters: first arg must be symbol")
+	}
+
+	jobs, err := StoreDeadLetters(queueName.Name())
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	rows := make([]map[string]any, 0, len(jobs))
+	for _, job := range jobs {
+		rows = append(rows, map[string]any{
+			"index":    int64(job.Index),
+			"attempts": job.Attempts,
+			"error":    job.LastError,
+			"msg":      job.Msg,
+		})
+	}
+
+	return parser.ToSexp(env, rows), nil
+}
+
+// fnReplayDeadLetters queues the dead letters of a queue again with their attempts reset
+// Lisp: (replayDeadLetters aQueue:)
+func fnReplayDeadLetters(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 1 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	queueName, ok := args[0].(*zygo.SexpSymbol)
+	if !ok {
+		return zygo.SexpNull, errors.New("replayDeadLetters: first arg must be symbol")
+	}
+
+	replayed, err := StoreReplay(queueName.Name())
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return &zygo.SexpInt{Val: int64(replayed)}, nil
+}
+
+// StoreDeadLetters lists the jobs of a queue that ran out of attempts, oldest first
+func StoreDeadLetters(queueName string) ([]*Job, error) {
+	var jobs []*Job
+
+	err := store.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		query := deadQuery(queueName)
+		for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+			item := it.Item()
+			index, ok := indexOf(item.Key(), query)
+			if !ok {
+				continue
+			}
+
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			msg := decodeEnvelope(queueName, value)
+			jobs = append(jobs, jobOf(msg, msg.Priority, index))
+		}
+
+		return nil
+	})
+
+	return jobs, err
+}
+
+// StoreReplay queues the dead letters of a queue again with their attempts reset
+func StoreReplay(queueName string) (int, error) {
+	query := deadQuery(queueName)
+
+	replayed, err := drainPrefix(query, func(txn *badger.Txn, key, value []byte) (bool, error) {
+		if _, ok := indexOf(key, query); !ok {
+			return false, nil
+		}
+
+		msg := decodeEnvelope(queueName, value)
+		return true, enqueue(txn, envelope{ID: msg.ID, Queue: queueName, Msg: msg.Msg, Priority: msg.Priority})
+	})
+	if replayed > 0 {
+		notifyQueued()
+	}
+
+	return replayed, err
+}
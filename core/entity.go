@@ -1,20 +1,58 @@
 package core
 
 import (
+	"github.com/glycerine/zygomys/v9/zygo"
 	"github.com/seapvnk/qokl/storage"
 )
 
+func init() {
+	// entity hooks run with the entity and store modules
+	storage.SetHookEnv(func() *zygo.Zlisp {
+		return NewVM().UseStoreModule().environment
+	})
+
+	// dispatches of entity transactions are queued once they commit
+	storage.SetOutboxRelay(RelayOutbox)
+}
+
 // Entity module setup
 func (vm *VM) UseEntityModule() *VM {
 	vm.environment.AddFunction("insert", storage.FnEntityInsert)
+	vm.environment.AddFunction("insertMany", storage.FnEntityInsertMany)
 	vm.environment.AddFunction("deleteEntity", storage.FnDeleteEntity)
 	vm.environment.AddFunction("deleteAll", storage.FnEntityDeleteAll)
 	vm.environment.AddFunction("entity", storage.FnEntityGet)
 	vm.environment.AddFunction("select", storage.FnEntitySelect)
+	vm.environment.AddFunction("each", storage.FnEntityEach)
 	vm.environment.AddFunction("update", storage.FnEntityUpdateAll)
 	vm.environment.AddFunction("addTag", storage.FnAddTag)
 	vm.environment.AddFunction("relationship", storage.FnRelationship)
 	vm.environment.AddFunction("relationshipsOf", storage.FnEntityRelationships)
+	vm.environment.AddFunction("onDelete", storage.FnOnDelete)
+	vm.environment.AddFunction("hasRole", storage.FnHasRole)
+	vm.environment.AddFunction("transaction", storage.FnTransaction)
+
+	// atomic operations
+	vm.environment.AddFunction("incr", storage.FnIncr)
+	vm.environment.AddFunction("decr", storage.FnDecr)
+	vm.environment.AddFunction("appendTo", storage.FnAppendTo)
+	vm.environment.AddFunction("compareAndSet", storage.FnCompareAndSet)
+
+	// spatial index
+	vm.environment.AddFunction("geoIndex", storage.FnGeoIndex)
+	vm.environment.AddFunction("near", storage.FnNear)
+	vm.environment.AddFunction("within", storage.FnWithin)
+
+	// blobs
+	vm.environment.AddFunction("putBlob", storage.FnPutBlob)
+	vm.environment.AddFunction("getBlob", storage.FnGetBlob)
+
+	// introspection
+	vm.environment.AddFunction("tags", storage.FnTags)
+	vm.environment.AddFunction("countTag", storage.FnCountTag)
+	vm.environment.AddFunction("componentsOf", storage.FnComponentsOf)
+	vm.environment.AddFunction("relationshipTypes", storage.FnRelationshipTypes)
+	vm.environment.AddFunction("storageStats", storage.FnStorageStats)
 
 	return vm
 }
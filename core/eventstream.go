@@ -0,0 +1,655 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+/*
+* # Event streams
+*
+* (appendStream %orders (msgpack (hash id: 1))) // returns the offset of the record
+* (readStream %orders from: 0 limit: 10)
+* (readGroup %orders %billing limit: 10) // records after the committed offset of billing
+* (commitOffset %orders %billing 3) // billing reads from offset 3 next
+* (retainStream %orders maxLength: 1000 maxAge: 86400) // maxAge in seconds
+* (streamInfo %orders)
+*
+* records are never removed by reading, every consumer group keeps its own offset.
+* Old records are only dropped by the retention of the stream.
+ */
+
+// StreamRecord a message appended to a stream
+type StreamRecord struct {
+	Offset     uint64    `json:"offset"`
+	Msg        []byte    `json:"msg"`
+	AppendedAt time.Time `json:"appendedAt"`
+}
+
+// StreamGroup the position of a consumer group, Offset is the next record it reads
+type StreamGroup struct {
+	Offset   uint64    `json:"offset"`
+	Attempts int       `json:"attempts"`
+	RetryAt  time.Time `json:"retryAt,omitzero"`
+}
+
+// StreamRetention the records kept by a stream, zero values keep everything
+type StreamRetention struct {
+	MaxLength int           `json:"maxLength,omitempty"`
+	MaxAge    time.Duration `json:"maxAge,omitempty"`
+}
+
+// StreamInfo the records and consumer groups of a stream
+type StreamInfo struct {
+	Name      string                 `json:"name"`
+	First     uint64                 `json:"first"`
+	Next      uint64                 `json:"next"`
+	Length    int                    `json:"length"`
+	Groups    map[string]StreamGroup `json:"groups"`
+	Retention StreamRetention        `json:"retention"`
+}
+
+func streamPrefix(stream string) []byte {
+	return []byte("stream." + stream + ".")
+}
+
+func streamKey(stream string, offset uint64) []byte {
+	return fmt.Appendf(nil, "stream.%s.%020d", stream, offset)
+}
+
+func streamNextKey(stream string) []byte {
+	return []byte("stream." + stream + ".meta.next")
+}
+
+func streamGroupKey(stream string, group string) []byte {
+	return []byte("stream." + stream + ".group." + group)
+}
+
+func streamGroupQuery(stream string) []byte {
+	return []byte("stream." + stream + ".group.")
+}
+
+func retentionKey(stream string) []byte {
+	return []byte("retention." + stream)
+}
+
+// fnAppendStream appends a message to a stream, returns its offset
+// Lisp: (appendStream %orders (msgpack (hash id: 1)))
+func fnAppendStream(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 2 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	stream, err := queueArg(name, args[:1], 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	value, ok := args[1].(*zygo.SexpRaw)
+	if !ok {
+		return zygo.SexpNull, errors.New("appendStream: second arg must serialized hash, use msgpack function")
+	}
+
+	offset, err := StoreAppend(stream, value.Val)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return &zygo.SexpInt{Val: int64(offset)}, nil
+}
+
+// fnReadStream reads the records of a stream from an offset, the oldest retained by default
+// Lisp: (readStream %orders from: 0 limit: 10)
+func fnReadStream(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 1 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	stream, err := queueArg(name, args[:1], 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	options, err := parser.Options(args[1:])
+	if err != nil {
+		return zygo.SexpNull, fmt.Errorf("%s: %w", name, err)
+	}
+
+	from := uint64(0)
+	if value, ok := options["from"].(*zygo.SexpInt); ok && value.Val > 0 {
+		from = uint64(value.Val)
+	}
+
+	records, err := StoreReadStream(stream, from, limitOption(options))
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return recordsToSexp(env, records), nil
+}
+
+// fnReadGroup reads the records of a stream a consumer group has not committed yet
+// Lisp: (readGroup %orders %billing limit: 10)
+func fnReadGroup(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 2 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	stream, group, err := streamGroupArgs(name, args)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	options, err := parser.Options(args[2:])
+	if err != nil {
+		return zygo.SexpNull, fmt.Errorf("%s: %w", name, err)
+	}
+
+	position, err := StoreGroup(stream, group)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	records, err := StoreReadStream(stream, position.Offset, limitOption(options))
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return recordsToSexp(env, records), nil
+}
+
+// fnCommitOffset sets the next record a consumer group reads
+// Lisp: (commitOffset %orders %billing 3)
+func fnCommitOffset(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 3 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	stream, group, err := streamGroupArgs(name, args)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	offset, ok := args[2].(*zygo.SexpInt)
+	if !ok || offset.Val < 0 {
+		return zygo.SexpNull, errors.New("commitOffset: third arg must be an offset")
+	}
+
+	if err := StoreCommitOffset(stream, group, uint64(offset.Val)); err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.SignalOk(env)
+}
+
+// fnRetainStream sets how many records and for how many seconds a stream keeps them
+// Lisp: (retainStream %orders maxLength: 1000 maxAge: 86400)
+func fnRetainStream(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 1 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	stream, err := queueArg(name, args[:1], 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	options, err := parser.Options(args[1:])
+	if err != nil {
+		return zygo.SexpNull, fmt.Errorf("%s: %w", name, err)
+	}
+
+	var retention StreamRetention
+	if value, ok := options["maxLength"].(*zygo.SexpInt); ok {
+		retention.MaxLength = int(value.Val)
+	}
+
+	switch value := options["maxAge"].(type) {
+	case *zygo.SexpInt:
+		retention.MaxAge = time.Duration(value.Val) * time.Second
+	case *zygo.SexpFloat:
+		retention.MaxAge = time.Duration(value.Val * float64(time.Second))
+	}
+
+	if retention.MaxLength < 0 || retention.MaxAge < 0 {
+		return zygo.SexpNull, errors.New("retainStream: maxLength and maxAge must be positive")
+	}
+
+	if err := StoreSetRetention(stream, retention); err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.SignalOk(env)
+}
+
+// fnStreamInfo returns the offsets, length and consumer groups of a stream
+// Lisp: (streamInfo %orders)
+func fnStreamInfo(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	stream, err := queueArg(name, args, 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	info, err := StoreStreamInfo(stream)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	groups := map[string]any{}
+	for group, position := range info.Groups {
+		groups[group] = int64(position.Offset)
+	}
+
+	return parser.ToSexp(env, map[string]any{
+		"name":   info.Name,
+		"first":  int64(info.First),
+		"next":   int64(info.Next),
+		"length": info.Length,
+		"groups": groups,
+	}), nil
+}
+
+func streamGroupArgs(name string, args []zygo.Sexp) (string, string, error) {
+	stream, ok := args[0].(*zygo.SexpSymbol)
+	if !ok {
+		return "", "", fmt.Errorf("%s: first arg must be symbol", name)
+	}
+
+	group, ok := args[1].(*zygo.SexpSymbol)
+	if !ok {
+		return "", "", fmt.Errorf("%s: second arg must be symbol", name)
+	}
+
+	return stream.Name(), group.Name(), nil
+}
+
+func limitOption(options map[string]zygo.Sexp) int {
+	if value, ok := options["limit"].(*zygo.SexpInt); ok && value.Val > 0 {
+		return int(value.Val)
+	}
+
+	return defaultListLimit
+}
+
+func recordsToSexp(env *zygo.Zlisp, records []StreamRecord) zygo.Sexp {
+	rows := make([]map[string]any, 0, len(records))
+	for _, record := range records {
+		rows = append(rows, map[string]any{
+			"offset":     int64(record.Offset),
+			"msg":        record.Msg,
+			"appendedAt": record.AppendedAt.Format(time.RFC3339Nano),
+		})
+	}
+
+	return parser.ToSexp(env, rows)
+}
+
+// StoreAppend appends msg to a stream, dropping the records its retention no longer keeps
+func StoreAppend(stream string, msg []byte) (uint64, error) {
+	var offset uint64
+	err := updateRetrying(func(txn *badger.Txn) error {
+		offset = 0
+		item, err := txn.Get(streamNextKey(stream))
+		if err == nil {
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			offset = bytesToUint64(value)
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		data, err := json.Marshal(StreamRecord{Offset: offset, Msg: msg, AppendedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+
+		if err := txn.Set(streamKey(stream, offset), data); err != nil {
+			return err
+		}
+
+		if err := txn.Set(streamNextKey(stream), uint64ToBytes(offset+1)); err != nil {
+			return err
+		}
+
+		retention, err := readRetention(txn, stream)
+		if err != nil {
+			return err
+		}
+
+		_, err = trimStream(txn, stream, retention, offset+1, time.Now())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	notifyQueued()
+	return offset, nil
+}
+
+// StoreReadStream reads up to limit records of a stream from an offset
+func StoreReadStream(stream string, from uint64, limit int) ([]StreamRecord, error) {
+	records := []StreamRecord{}
+
+	err := store.View(func(txn *badger.Txn) error {
+		return eachRecord(txn, stream, from, func(record StreamRecord) bool {
+			records = append(records, record)
+			return len(records) < limit
+		})
+	})
+
+	return records, err
+}
+
+// StoreGroup returns the position of a consumer group, new groups read from the start
+func StoreGroup(stream string, group string) (StreamGroup, error) {
+	var position StreamGroup
+
+	err := store.View(func(txn *badger.Txn) error {
+		var err error
+		position, err = readGroup(txn, stream, group)
+		return err
+	})
+
+	return position, err
+}
+
+// StoreCommitOffset sets the next record a consumer group reads, clearing its retries
+func StoreCommitOffset(stream string, group string, offset uint64) error {
+	return updateRetrying(func(txn *badger.Txn) error {
+		return saveGroup(txn, stream, group, StreamGroup{Offset: offset})
+	})
+}
+
+// StoreRetryRecord counts a failed attempt of a consumer group at its offset, returns the attempts
+func StoreRetryRecord(stream string, group string, retryAt time.Time) (int, error) {
+	attempts := 0
+
+	err := updateRetrying(func(txn *badger.Txn) error {
+		position, err := readGroup(txn, stream, group)
+		if err != nil {
+			return err
+		}
+
+		position.Attempts++
+		position.RetryAt = retryAt
+		attempts = position.Attempts
+		return saveGroup(txn, stream, group, position)
+	})
+
+	return attempts, err
+}
+
+// StoreSetRetention sets the retention of a stream and applies it
+func StoreSetRetention(stream string, retention StreamRetention) error {
+	return updateRetrying(func(txn *badger.Txn) error {
+		if retention == (StreamRetention{}) {
+			return txn.Delete(retentionKey(stream))
+		}
+
+		data, err := json.Marshal(retention)
+		if err != nil {
+			return err
+		}
+
+		if err := txn.Set(retentionKey(stream), data); err != nil {
+			return err
+		}
+
+		next, err := nextOffset(txn, stream)
+		if err != nil {
+			return err
+		}
+
+		_, err = trimStream(txn, stream, retention, next, time.Now())
+		return err
+	})
+}
+
+// StoreTrimStreams drops the records older than the retention of their stream, returns how many.
+// Only the streams having such records are written.
+func StoreTrimStreams(now time.Time) (int, error) {
+	retentions := map[string]StreamRetention{}
+
+	err := store.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("retention.")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var retention StreamRetention
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &retention)
+			})
+			if err != nil {
+				return err
+			}
+
+			if retention.MaxAge > 0 {
+				retentions[strings.TrimPrefix(string(it.Item().Key()), string(prefix))] = retention
+			}
+		}
+
+		// streams whose oldest record is still kept are not written
+		for stream, retention := range retentions {
+			expired := false
+			err := eachRecord(txn, stream, 0, func(record StreamRecord) bool {
+				expired = now.Sub(record.AppendedAt) > retention.MaxAge
+				return false
+			})
+			if err != nil {
+				return err
+			}
+
+			if !expired {
+				delete(retentions, stream)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	trimmed := 0
+	for stream, retention := range retentions {
+		err := updateRetrying(func(txn *badger.Txn) error {
+			next, err := nextOffset(txn, stream)
+			if err != nil {
+				return err
+			}
+
+			count, err := trimStream(txn, stream, retention, next, now)
+			trimmed += count
+			return err
+		})
+		if err != nil {
+			return trimmed, err
+		}
+	}
+
+	return trimmed, nil
+}
+
+// StoreStreamInfo returns the offsets, length and consumer groups of a stream
+func StoreStreamInfo(stream string) (StreamInfo, error) {
+	info := StreamInfo{Name: stream, Groups: map[string]StreamGroup{}}
+
+	err := store.View(func(txn *badger.Txn) error {
+		var err error
+		if info.Next, err = nextOffset(txn, stream); err != nil {
+			return err
+		}
+		info.First = info.Next
+
+		err = eachRecord(txn, stream, 0, func(record StreamRecord) bool {
+			if info.Length == 0 {
+				info.First = record.Offset
+			}
+			info.Length++
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		if info.Retention, err = readRetention(txn, stream); err != nil {
+			return err
+		}
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		query := streamGroupQuery(stream)
+		for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+			var position StreamGroup
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &position)
+			})
+			if err != nil {
+				return err
+			}
+
+			info.Groups[strings.TrimPrefix(string(it.Item().Key()), string(query))] = position
+		}
+
+		return nil
+	})
+
+	return info, err
+}
+
+// eachRecord passes the records of a stream from an offset to fn until it returns false
+func eachRecord(txn *badger.Txn, stream string, from uint64, fn func(record StreamRecord) bool) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	// records sort before the meta and group keys of the stream
+	prefix := streamPrefix(stream)
+	for it.Seek(streamKey(stream, from)); it.ValidForPrefix(prefix); it.Next() {
+		suffix := strings.TrimPrefix(string(it.Item().Key()), string(prefix))
+		if _, err := strconv.ParseUint(suffix, 10, 64); err != nil || len(suffix) != 20 {
+			return nil
+		}
+
+		var record StreamRecord
+		err := it.Item().Value(func(v []byte) error {
+			return json.Unmarshal(v, &record)
+		})
+		if err != nil {
+			return err
+		}
+
+		if !fn(record) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// trimStream deletes the oldest records beyond the retention of a stream, next is the offset of the next append
+func trimStream(txn *badger.Txn, stream string, retention StreamRetention, next uint64, now time.Time) (int, error) {
+	if retention == (StreamRetention{}) {
+		return 0, nil
+	}
+
+	var stale []uint64
+	err := eachRecord(txn, stream, 0, func(record StreamRecord) bool {
+		tooMany := retention.MaxLength > 0 && next-record.Offset > uint64(retention.MaxLength)
+		tooOld := retention.MaxAge > 0 && now.Sub(record.AppendedAt) > retention.MaxAge
+		if !tooMany && !tooOld {
+			return false
+		}
+
+		stale = append(stale, record.Offset)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, offset := range stale {
+		if err := txn.Delete(streamKey(stream, offset)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(stale), nil
+}
+
+func nextOffset(txn *badger.Txn, stream string) (uint64, error) {
+	item, err := txn.Get(streamNextKey(stream))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return bytesToUint64(value), nil
+}
+
+func readGroup(txn *badger.Txn, stream string, group string) (StreamGroup, error) {
+	var position StreamGroup
+
+	item, err := txn.Get(streamGroupKey(stream, group))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return position, nil
+	}
+
+	if err != nil {
+		return position, err
+	}
+
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &position)
+	})
+
+	return position, err
+}
+
+func saveGroup(txn *badger.Txn, stream string, group string, position StreamGroup) error {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(streamGroupKey(stream, group), data)
+}
+
+func readRetention(txn *badger.Txn, stream string) (StreamRetention, error) {
+	var retention StreamRetention
+
+	item, err := txn.Get(retentionKey(stream))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return retention, nil
+	}
+
+	if err != nil {
+		return retention, err
+	}
+
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &retention)
+	})
+
+	return retention, err
+}
@@ -0,0 +1,505 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+func pausedKey(name string) []byte {
+	return []byte("paused." + name)
+}
+
+// QueueInfo the state of a queue, Length counts the messages waiting in every priority lane
+type QueueInfo struct {
+	Name     string      `json:"name"`
+	Length   int         `json:"length"`
+	Lanes    map[int]int `json:"lanes"`
+	Inflight int         `json:"inflight"`
+	Dead     int         `json:"dead"`
+	Paused   bool        `json:"paused"`
+}
+
+// fnQueues lists the queues and their state
+// Lisp: (queues)
+func fnQueues(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 0 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	infos, err := StoreQueues()
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	rows := make([]map[string]any, 0, len(infos))
+	for _, info := range infos {
+		rows = append(rows, map[string]any{
+			"name":     info.Name,
+			"length":   info.Length,
+			"inflight": info.Inflight,
+			"dead":     info.Dead,
+			"paused":   info.Paused,
+		})
+	}
+
+	return parser.ToSexp(env, rows), nil
+}
+
+// fnQueueLength counts the messages waiting in a queue
+// Lisp: (queueLength aQueue:)
+func fnQueueLength(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	queueName, err := queueArg(name, args, 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	info, err := StoreQueueInfo(queueName)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return &zygo.SexpInt{Val: int64(info.Length)}, nil
+}
+
+// fnPeekQueue returns the message a queue serves next without taking it, nil when it is empty
+// Lisp: (peekQueue aQueue:)
+func fnPeekQueue(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	queueName, err := queueArg(name, args, 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	job, err := StorePeek(queueName)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	if job == nil {
+		return zygo.SexpNull, nil
+	}
+
+	return parser.ToSexp(env, jobRow(job)), nil
+}
+
+// fnListQueue lists the messages waiting in a queue, urgent ones first
+// Lisp: (listQueue aQueue: offset: 0 limit: 100)
+func fnListQueue(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 1 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	queueName, err := queueArg(name, args[:1], 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	options, err := parser.Options(args[1:])
+	if err != nil {
+		return zygo.SexpNull, fmt.Errorf("%s: %w", name, err)
+	}
+
+	offset, limit := 0, defaultListLimit
+	if value, ok := options["offset"].(*zygo.SexpInt); ok {
+		offset = int(value.Val)
+	}
+	if value, ok := options["limit"].(*zygo.SexpInt); ok {
+		limit = int(value.Val)
+	}
+
+	jobs, err := StoreList(queueName, offset, limit)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	rows := make([]map[string]any, 0, len(jobs))
+	for _, job := range jobs {
+		rows = append(rows, jobRow(job))
+	}
+
+	return parser.ToSexp(env, rows), nil
+}
+
+// fnPurgeQueue deletes the messages waiting in a queue, returns how many
+// Lisp: (purgeQueue aQueue:)
+func fnPurgeQueue(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	queueName, err := queueArg(name, args, 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	purged, err := StorePurge(queueName)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return &zygo.SexpInt{Val: int64(purged)}, nil
+}
+
+// fnMoveQueue moves the messages waiting in a queue to another, returns how many
+// Lisp: (moveQueue from: to:)
+func fnMoveQueue(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 2 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	from, fromOk := args[0].(*zygo.SexpSymbol)
+	to, toOk := args[1].(*zygo.SexpSymbol)
+	if !fromOk || !toOk {
+		return zygo.SexpNull, errors.New("moveQueue: queues must be symbols")
+	}
+
+	moved, err := StoreMove(from.Name(), to.Name())
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return &zygo.SexpInt{Val: int64(moved)}, nil
+}
+
+// fnPauseQueue stops serving a queue, dispatch keeps queuing its messages
+// Lisp: (pauseQueue aQueue:)
+func fnPauseQueue(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	queueName, err := queueArg(name, args, 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	if err := StorePause(queueName); err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.SignalOk(env)
+}
+
+// fnResumeQueue serves a paused queue again
+// Lisp: (resumeQueue aQueue:)
+func fnResumeQueue(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	queueName, err := queueArg(name, args, 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	if err := StoreResume(queueName); err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.SignalOk(env)
+}
+
+func queueArg(name string, args []zygo.Sexp, nargs int) (string, error) {
+	if len(args) != nargs {
+		return "", zygo.WrongNargs
+	}
+
+	queueName, ok := args[0].(*zygo.SexpSymbol)
+	if !ok {
+		return "", fmt.Errorf("%s: first arg must be symbol", name)
+	}
+
+	return queueName.Name(), nil
+}
+
+func jobRow(job *Job) map[string]any {
+	return map[string]any{
+		"id":       job.ID,
+		"index":    int64(job.Index),
+		"priority": job.Priority,
+		"attempts": job.Attempts,
+		"error":    job.LastError,
+		"msg":      job.Msg,
+	}
+}
+
+// StoreQueues lists the state of every queue that ever had a message, sorted by name
+func StoreQueues() ([]QueueInfo, error) {
+	var names []string
+
+	err := store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := "queue."
+		seen := map[string]bool{}
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); {
+			// queue names can have dots, like topic handlers: queue.<lane>.meta.<label> or queue.<lane>.<index>
+			rest := strings.TrimPrefix(string(it.Item().Key()), prefix)
+			end := strings.LastIndex(rest, ".meta.")
+			if end < 0 {
+				end = strings.LastIndex(rest, ".")
+			}
+
+			if end < 0 {
+				it.Next()
+				continue
+			}
+			lane := rest[:end]
+
+			queueName, _, _ := strings.Cut(lane, "#")
+			if !seen[queueName] {
+				seen[queueName] = true
+				names = append(names, queueName)
+			}
+
+			// "/" is the byte right after ".", seeking it skips the messages of the lane
+			it.Seek([]byte(prefix + lane + "/"))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	infos := make([]QueueInfo, 0, len(names))
+	for _, queueName := range names {
+		info, err := StoreQueueInfo(queueName)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// StoreQueueInfo reads the state of a queue from the head and tail of its lanes
+func StoreQueueInfo(queueName string) (QueueInfo, error) {
+	info := QueueInfo{Name: queueName, Lanes: map[int]int{}}
+
+	err := store.View(func(txn *badger.Txn) error {
+		for _, priority := range lanesOf(txn, queueName) {
+			lane := laneName(queueName, priority)
+			waiting := int(laneTail(txn, lane) - laneHead(txn, lane))
+			info.Lanes[priority] = waiting
+			info.Length += waiting
+			info.Inflight += countPrefix(txn, []byte(fmt.Sprintf("inflight.%s.", lane)))
+		}
+
+		info.Dead = countPrefix(txn, deadQuery(queueName))
+
+		_, err := txn.Get(pausedKey(queueName))
+		info.Paused = err == nil
+		return nil
+	})
+
+	return info, err
+}
+
+// StorePeek returns the message a queue serves next without taking it, nil when it is empty
+func StorePeek(queueName string) (*Job, error) {
+	var job *Job
+
+	err := store.View(func(txn *badger.Txn) error {
+		priority, found := pickLane(txn, queueName, time.Now())
+		if !found {
+			return nil
+		}
+
+		lane := laneName(queueName, priority)
+		head := laneHead(txn, lane)
+
+		var err error
+		job, err = readJob(txn, queueName, priority, head)
+		return err
+	})
+
+	return job, err
+}
+
+// StoreList lists the messages waiting in a queue, lanes by priority and each lane oldest first
+func StoreList(queueName string, offset, limit int) ([]*Job, error) {
+	jobs := []*Job{}
+
+	err := store.View(func(txn *badger.Txn) error {
+		for _, priority := range lanesOf(txn, queueName) {
+			lane := laneName(queueName, priority)
+			for index := laneHead(txn, lane); index < laneTail(txn, lane); index++ {
+				if len(jobs) >= limit {
+					return nil
+				}
+
+				if offset > 0 {
+					offset--
+					continue
+				}
+
+				job, err := readJob(txn, queueName, priority, index)
+				if err != nil {
+					return err
+				}
+				jobs = append(jobs, job)
+			}
+		}
+
+		return nil
+	})
+
+	return jobs, err
+}
+
+// StorePurge deletes the messages waiting in a queue and their job status, jobs in flight are kept.
+// Purged cron jobs let their schedule run again and purged workflow steps fail.
+func StorePurge(queueName string) (int, error) {
+	return drainQueue(queueName, func(txn *badger.Txn, msg envelope, priority int, index uint64) error {
+		if msg.ID != "" {
+			if err := txn.Delete(jobKey(msg.ID)); err != nil {
+				return err
+			}
+		}
+
+		if err := cronDone(txn, queueName, msg.ScheduledAt); err != nil {
+			return err
+		}
+
+		if msg.Workflow == "" {
+			return nil
+		}
+
+		return stepDone(txn, jobOf(msg, priority, index), StepFailed, nil, "purged from "+queueName)
+	})
+}
+
+// StoreMove moves the messages waiting in a queue to the end of another, keeping their priority.
+// Moved cron jobs become plain jobs of the other queue and let their schedule run again.
+func StoreMove(from, to string) (int, error) {
+	if from == to {
+		return 0, nil
+	}
+
+	moved, err := drainQueue(from, func(txn *badger.Txn, msg envelope, priority int, index uint64) error {
+		if err := cronDone(txn, from, msg.ScheduledAt); err != nil {
+			return err
+		}
+		msg.ScheduledAt = time.Time{}
+
+		msg.Queue = to
+		return enqueue(txn, msg)
+	})
+	if moved > 0 {
+		notifyQueued()
+	}
+
+	return moved, err
+}
+
+// drainQueue passes the messages waiting in a queue to fn and deletes them, queueBatchSize
+// messages per transaction so large queues fit. Returns how many were drained.
+func drainQueue(queueName string, fn func(txn *badger.Txn, msg envelope, priority int, index uint64) error) (int, error) {
+	drained := 0
+
+	for {
+		count := 0
+		err := updateRetrying(func(txn *badger.Txn) error {
+			count = 0
+
+			for _, priority := range lanesOf(txn, queueName) {
+				lane := laneName(queueName, priority)
+				head, tail := laneHead(txn, lane), laneTail(txn, lane)
+
+				index := head
+				for ; index < tail && count < queueBatchSize; index++ {
+					key := queueKey(lane, index)
+					item, err := txn.Get(key)
+					if err != nil {
+						return err
+					}
+
+					value, err := item.ValueCopy(nil)
+					if err != nil {
+						return err
+					}
+
+					if err := fn(txn, decodeEnvelope(queueName, value), priority, index); err != nil {
+						return err
+					}
+
+					if err := txn.Delete(key); err != nil {
+						return err
+					}
+					count++
+				}
+
+				if index > head {
+					if err := txn.Set(metaKey(lane, "head"), uint64ToBytes(index)); err != nil {
+						return err
+					}
+				}
+
+				if count == queueBatchSize {
+					return nil
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil || count == 0 {
+			return drained, err
+		}
+		drained += count
+	}
+}
+
+// StorePause stops serving a queue until it is resumed
+func StorePause(queueName string) error {
+	return store.Update(func(txn *badger.Txn) error {
+		return txn.Set(pausedKey(queueName), []byte("1"))
+	})
+}
+
+// StoreResume serves a paused queue again
+func StoreResume(queueName string) error {
+	err := store.Update(func(txn *badger.Txn) error {
+		return txn.Delete(pausedKey(queueName))
+	})
+	if err == nil {
+		notifyQueued()
+	}
+
+	return err
+}
+
+func isPaused(txn *badger.Txn, queueName string) bool {
+	_, err := txn.Get(pausedKey(queueName))
+	return err == nil
+}
+
+func readJob(txn *badger.Txn, queueName string, priority int, index uint64) (*Job, error) {
+	item, err := txn.Get(queueKey(laneName(queueName, priority), index))
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return jobOf(decodeEnvelope(queueName, value), priority, index), nil
+}
+
+func countPrefix(txn *badger.Txn, prefix []byte) int {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	count := 0
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if _, ok := indexOf(it.Item().Key(), prefix); ok {
+			count++
+		}
+	}
+
+	return count
+}
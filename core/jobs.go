@@ -0,0 +1,197 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// JobStatus progress of a dispatched job, kept for jobStatusTTL after its last change.
+// Result is the value returned by the task script once it succeeded.
+type JobStatus struct {
+	ID         string     `json:"id"`
+	Queue      string     `json:"queue"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error,omitempty"`
+	Result     any        `json:"result,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+func jobKey(id string) []byte {
+	return []byte("job." + id)
+}
+
+// fnJobStatus returns the status of a job by the id dispatch returned, nil when it is unknown
+// Lisp: (jobStatus id)
+func fnJobStatus(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 1 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	id, ok := args[0].(*zygo.SexpStr)
+	if !ok {
+		return zygo.SexpNull, errors.New("jobStatus: first arg must be a job id string")
+	}
+
+	status, err := StoreJobStatus(id.S)
+	if errors.Is(err, ErrJobNotFound) {
+		return zygo.SexpNull, nil
+	}
+
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	row := map[string]any{
+		"id":        status.ID,
+		"queue":     status.Queue,
+		"status":    status.Status,
+		"attempts":  status.Attempts,
+		"createdAt": status.CreatedAt.Format(time.RFC3339Nano),
+	}
+	if status.Error != "" {
+		row["error"] = status.Error
+	}
+	if status.Result != nil {
+		row["result"] = status.Result
+	}
+	if status.StartedAt != nil {
+		row["startedAt"] = status.StartedAt.Format(time.RFC3339Nano)
+	}
+	if status.FinishedAt != nil {
+		row["finishedAt"] = status.FinishedAt.Format(time.RFC3339Nano)
+	}
+
+	return parser.ToSexp(env, row), nil
+}
+
+// StoreJobStatus reads the status of a job
+func StoreJobStatus(id string) (*JobStatus, error) {
+	var status *JobStatus
+
+	err := store.View(func(txn *badger.Txn) error {
+		var err error
+		status, err = readStatus(txn, id)
+		return err
+	})
+
+	return status, err
+}
+
+// StoreComplete acks a job that succeeded, recording the result of its task
+// and queuing the workflow steps waiting for it
+func StoreComplete(job *Job, result any) error {
+	err := updateRetrying(func(txn *badger.Txn) error {
+		return complete(txn, job, result)
+	})
+	if err == nil && job.Workflow != "" {
+		notifyQueued()
+	}
+
+	return err
+}
+
+func complete(txn *badger.Txn, job *Job, result any) error {
+	if err := txn.Delete(inflightKey(laneName(job.Queue, job.Priority), job.Index)); err != nil {
+		return err
+	}
+
+	if err := cronDone(txn, job.Queue, job.ScheduledAt); err != nil {
+		return err
+	}
+
+	err := updateStatus(txn, job.ID, job.Queue, func(status *JobStatus) {
+		now := time.Now()
+		status.Status = JobSucceeded
+		status.Error = ""
+		status.Result = result
+		status.FinishedAt = &now
+	})
+	if err != nil || job.Workflow == "" {
+		return err
+	}
+
+	return stepDone(txn, job, StepSucceeded, result, "")
+}
+
+// updateRetrying runs an update again when it conflicts with a concurrent one,
+// like the steps of a workflow finishing together
+func updateRetrying(fn func(txn *badger.Txn) error) error {
+	var err error
+	for range conflictRetries {
+		if err = store.Update(fn); !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func readStatus(txn *badger.Txn, id string) (*JobStatus, error) {
+	item, err := txn.Get(jobKey(id))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrJobNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var status JobStatus
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &status)
+	})
+
+	return &status, err
+}
+
+// updateStatus changes the status of a job, created as queued when it has none.
+// Messages queued by older versions have no id and are not tracked.
+func updateStatus(txn *badger.Txn, id string, queueName string, change func(status *JobStatus)) error {
+	if id == "" {
+		return nil
+	}
+
+	status, err := readStatus(txn, id)
+	if errors.Is(err, ErrJobNotFound) {
+		status = &JobStatus{ID: id, Queue: queueName, Status: JobQueued, CreatedAt: time.Now()}
+	} else if err != nil {
+		return err
+	}
+
+	change(status)
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	return txn.SetEntry(badger.NewEntry(jobKey(id), data).WithTTL(jobStatusTTL))
+}
+
+// markQueued records that a message waits in its queue, or to be promoted to it
+func markQueued(txn *badger.Txn, msg envelope) error {
+	return updateStatus(txn, msg.ID, msg.Queue, func(status *JobStatus) {
+		status.Queue = msg.Queue
+		status.Status = JobQueued
+		status.Attempts = msg.Attempts
+		status.Error = msg.Error
+		status.FinishedAt = nil
+	})
+}
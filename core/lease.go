@@ -0,0 +1,256 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrLeaseNotFound = errors.New("lease not found or expired")
+	errLeaseExpired  = errors.New("lease expired")
+)
+
+// Lease a job reserved by an external worker until ExpiresAt, the visibility timeout.
+// Leases that expire fail their job, it is retried until it ran MaxAttempts times.
+type Lease struct {
+	ID          string    `json:"id"`
+	Job         *Job      `json:"job"`
+	MaxAttempts int       `json:"maxAttempts"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+func leaseKey(id string) []byte {
+	return []byte("lease." + id)
+}
+
+// lease expiries are sorted by time, across queues
+func leaseExpiryKey(expiresAt time.Time, id string) []byte {
+	return []byte(fmt.Sprintf("leasex.%020d.%s", expiresAt.UnixNano(), id))
+}
+
+// StoreLease reserves the next job of a queue for visibility, ErrQueueEmpty when there is none
+func StoreLease(queueName string, visibility time.Duration, maxAttempts int) (*Lease, error) {
+	if _, err := StoreExpireLeases(time.Now()); err != nil {
+		return nil, err
+	}
+
+	var lease *Lease
+
+	err := store.Update(func(txn *badger.Txn) error {
+		job, err := reserve(txn, queueName)
+		if err != nil {
+			return err
+		}
+
+		lease = &Lease{
+			ID:          uuid.NewString(),
+			Job:         job,
+			MaxAttempts: maxAttempts,
+			ExpiresAt:   time.Now().Add(visibility),
+		}
+
+		return saveLease(txn, lease)
+	})
+
+	return lease, err
+}
+
+// StoreLeaseOf reads an active lease
+func StoreLeaseOf(id string) (*Lease, error) {
+	var lease *Lease
+
+	err := store.View(func(txn *badger.Txn) error {
+		var err error
+		lease, err = readLease(txn, id)
+		return err
+	})
+
+	return lease, err
+}
+
+// StoreExtendLease pushes back the expiry of a lease to visibility from now
+func StoreExtendLease(id string, visibility time.Duration) (*Lease, error) {
+	var lease *Lease
+
+	err := store.Update(func(txn *badger.Txn) error {
+		var err error
+		if lease, err = readLease(txn, id); err != nil {
+			return err
+		}
+
+		if err := txn.Delete(leaseExpiryKey(lease.ExpiresAt, id)); err != nil {
+			return err
+		}
+
+		lease.ExpiresAt = time.Now().Add(visibility)
+		return saveLease(txn, lease)
+	})
+
+	return lease, err
+}
+
+// StoreAckLease completes the job of a lease with the result of the worker
+func StoreAckLease(id string, result any) error {
+	var job *Job
+
+	err := updateRetrying(func(txn *badger.Txn) error {
+		lease, err := takeLease(txn, id)
+		if err != nil {
+			return err
+		}
+
+		job = lease.Job
+		return complete(txn, job, result)
+	})
+	if err == nil && job.Workflow != "" {
+		notifyQueued()
+	}
+
+	return err
+}
+
+// StoreNackLease fails the job of a lease, it is retried after delay while it has attempts left
+func StoreNackLease(id string, cause error, delay time.Duration) error {
+	err := updateRetrying(func(txn *badger.Txn) error {
+		lease, err := takeLease(txn, id)
+		if err != nil {
+			return err
+		}
+
+		return fail(txn, lease.Job, cause, lease.MaxAttempts, delay)
+	})
+	if err == nil {
+		notifyQueued()
+	}
+
+	return err
+}
+
+// StoreExpireLeases fails the jobs of the leases expired at now, returns how many
+func StoreExpireLeases(now time.Time) (int, error) {
+	expired := 0
+	prefix := []byte("leasex.")
+
+	err := updateRetrying(func(txn *badger.Txn) error {
+		expired = 0
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		var ids []string
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			expiry, id, _ := strings.Cut(strings.TrimPrefix(string(it.Item().Key()), string(prefix)), ".")
+			expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+			if err != nil || expiresAt > now.UnixNano() {
+				break
+			}
+			ids = append(ids, id)
+		}
+
+		for _, id := range ids {
+			lease, err := takeLease(txn, id)
+			if errors.Is(err, ErrLeaseNotFound) {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if err := fail(txn, lease.Job, errLeaseExpired, lease.MaxAttempts, 0); err != nil {
+				return err
+			}
+			expired++
+		}
+
+		return nil
+	})
+	if err == nil && expired > 0 {
+		notifyQueued()
+	}
+
+	return expired, err
+}
+
+// StoreNextLeaseExpiry returns when the next lease expires, false when there is none
+func StoreNextLeaseExpiry() (time.Time, bool) {
+	return firstDue([]byte("leasex."))
+}
+
+// leasedKeys returns the in-flight keys of leased jobs, they stay in flight across restarts
+// until their lease is acked, nacked or expires
+func leasedKeys(txn *badger.Txn) (map[string]bool, error) {
+	leased := map[string]bool{}
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	prefix := []byte("lease.")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var lease Lease
+		err := it.Item().Value(func(v []byte) error {
+			return json.Unmarshal(v, &lease)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		leased[string(inflightKey(laneName(lease.Job.Queue, lease.Job.Priority), lease.Job.Index))] = true
+	}
+
+	return leased, nil
+}
+
+func saveLease(txn *badger.Txn, lease *Lease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Set(leaseKey(lease.ID), data); err != nil {
+		return err
+	}
+
+	return txn.Set(leaseExpiryKey(lease.ExpiresAt, lease.ID), []byte{})
+}
+
+func readLease(txn *badger.Txn, id string) (*Lease, error) {
+	item, err := txn.Get(leaseKey(id))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrLeaseNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var lease Lease
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &lease)
+	})
+
+	return &lease, err
+}
+
+// takeLease ends a lease so its job can be completed or failed
+func takeLease(txn *badger.Txn, id string) (*Lease, error) {
+	lease, err := readLease(txn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := txn.Delete(leaseKey(id)); err != nil {
+		return nil, err
+	}
+
+	return lease, txn.Delete(leaseExpiryKey(lease.ExpiresAt, id))
+}
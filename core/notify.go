@@ -0,0 +1,67 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// queued is closed and replaced whenever messages are queued or scheduled,
+// waking up every consumer waiting on it
+var (
+	queued   = make(chan struct{})
+	queuedMu sync.Mutex
+)
+
+// StoreQueued returns a channel closed the next time a message is queued or scheduled.
+// Take it before looking for messages so none queued in between is missed.
+func StoreQueued() <-chan struct{} {
+	queuedMu.Lock()
+	defer queuedMu.Unlock()
+
+	return queued
+}
+
+func notifyQueued() {
+	queuedMu.Lock()
+	defer queuedMu.Unlock()
+
+	close(queued)
+	queued = make(chan struct{})
+}
+
+// StoreNextDue returns when the next delayed message is due, false when there is none
+func StoreNextDue() (time.Time, bool) {
+	return firstDue([]byte("delayed."))
+}
+
+// firstDue reads the time of the first key of a keyspace sorted by time, like delayed.<nanos>.<id>
+func firstDue(prefix []byte) (time.Time, bool) {
+	var due time.Time
+	found := false
+
+	store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			nanos, _, _ := strings.Cut(strings.TrimPrefix(string(it.Item().Key()), string(prefix)), ".")
+			readyAt, err := strconv.ParseInt(nanos, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			due, found = time.Unix(0, readyAt), true
+			return nil
+		}
+
+		return nil
+	})
+
+	return due, found
+}
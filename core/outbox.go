@@ -0,0 +1,94 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/storage"
+)
+
+var (
+	// held while relaying so the store is not closed under it
+	relayMu sync.Mutex
+
+	// when a failed relay is tried again and how long it waited, zero once a relay succeeds
+	relayRetryAt time.Time
+	relayBackoff time.Duration
+	relayRetryMu sync.Mutex
+)
+
+// RelayOutbox queues the dispatches of committed entity transactions, a failed relay
+// is tried again by the task listener after a backoff
+func RelayOutbox() {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	if store == nil || store.IsClosed() {
+		return
+	}
+
+	relayed, err := storage.RelayOutbox(deliverOutbox)
+	if relayed > 0 {
+		notifyQueued()
+	}
+
+	relayRetryMu.Lock()
+	defer relayRetryMu.Unlock()
+
+	if err == nil {
+		relayRetryAt, relayBackoff = time.Time{}, 0
+		return
+	}
+
+	relayBackoff = min(max(2*relayBackoff, outboxRetryDelay), outboxMaxRetryDelay)
+	relayRetryAt = time.Now().Add(relayBackoff)
+	log.Printf("outbox relay failed, retrying in %s: %v", relayBackoff, err)
+
+	// wakes the listener to wait for the retry
+	notifyQueued()
+}
+
+// StoreNextRelay returns when a failed outbox relay is tried again, false when none failed
+func StoreNextRelay() (time.Time, bool) {
+	relayRetryMu.Lock()
+	defer relayRetryMu.Unlock()
+
+	return relayRetryAt, !relayRetryAt.IsZero()
+}
+
+// deliverOutbox queues an entry unless a job with its id exists, it may be relayed twice after a crash
+func deliverOutbox(entry storage.OutboxEntry) error {
+	msg := envelope{ID: entry.ID, Queue: entry.Queue, Msg: entry.Msg, Priority: entry.Priority}
+
+	return updateRetrying(func(txn *badger.Txn) error {
+		if _, err := readStatus(txn, msg.ID); !errors.Is(err, ErrJobNotFound) {
+			return err
+		}
+
+		if !entry.ReadyAt.IsZero() {
+			return schedule(txn, msg, entry.ReadyAt)
+		}
+
+		return enqueue(txn, msg)
+	})
+}
+
+// toOutbox records a dispatch made inside an entity transaction, queued once it commits
+func toOutbox(env *zygo.Zlisp, msg envelope, readyAt time.Time) (zygo.Sexp, error) {
+	err := storage.AddToOutbox(env, storage.OutboxEntry{
+		ID:       msg.ID,
+		Queue:    msg.Queue,
+		Msg:      msg.Msg,
+		Priority: msg.Priority,
+		ReadyAt:  readyAt,
+	})
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	return &zygo.SexpStr{S: msg.ID}, nil
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// laneName names the keyspace of a priority lane, priority 0 is the queue itself
+func laneName(queueName string, priority int) string {
+	if priority == 0 {
+		return queueName
+	}
+
+	return fmt.Sprintf("%s#%d", queueName, priority)
+}
+
+func laneKey(queueName string, priority int) []byte {
+	return []byte(fmt.Sprintf("lanes.%s.%d", queueName, priority))
+}
+
+func laneQuery(queueName string) []byte {
+	return []byte(fmt.Sprintf("lanes.%s.", queueName))
+}
+
+// lanesOf lists the priorities a queue was dispatched with, highest first
+func lanesOf(txn *badger.Txn, queueName string) []int {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	lanes := []int{0}
+	query := laneQuery(queueName)
+	for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+		priority, err := strconv.Atoi(strings.TrimPrefix(string(it.Item().Key()), string(query)))
+		if err == nil && priority != 0 {
+			lanes = append(lanes, priority)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(lanes)))
+	return lanes
+}
+
+// laneHead position of the oldest message of a lane
+func laneHead(txn *badger.Txn, lane string) uint64 {
+	var head uint64
+	item, err := txn.Get(metaKey(lane, "head"))
+	if err == nil {
+		val, _ := item.ValueCopy(nil)
+		head = bytesToUint64(val)
+	}
+
+	return head
+}
+
+// pickLane chooses the lane to serve next, the one with the highest priority once the
+// messages at their head are aged: a message gains a priority point every
+// priorityAging it waits, so low priorities are never starved. Returns false when
+// every lane is empty.
+func pickLane(txn *badger.Txn, queueName string, now time.Time) (int, bool) {
+	best, bestScore, found := 0, 0.0, false
+
+	for _, priority := range lanesOf(txn, queueName) {
+		lane := laneName(queueName, priority)
+		item, err := txn.Get(queueKey(lane, laneHead(txn, lane)))
+		if err != nil {
+			continue
+		}
+
+		score := float64(priority)
+		item.Value(func(v []byte) error {
+			msg := decodeEnvelope(queueName, v)
+			if !msg.EnqueuedAt.IsZero() {
+				score += float64(now.Sub(msg.EnqueuedAt)) / float64(priorityAging)
+			}
+			return nil
+		})
+
+		if !found || score > bestScore {
+			best, bestScore, found = priority, score, true
+		}
+	}
+
+	return best, found
+}
+
+// laneTail position right after the newest message of a lane
+func laneTail(txn *badger.Txn, lane string) uint64 {
+	var tail uint64
+	item, err := txn.Get(metaKey(lane, "tail"))
+	if err == nil {
+		val, _ := item.ValueCopy(nil)
+		tail = bytesToUint64(val)
+	}
+
+	return tail
+}
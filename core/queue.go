@@ -2,13 +2,25 @@ package core
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	badger "github.com/dgraph-io/badger/v4"
 	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/google/uuid"
+	"github.com/seapvnk/qokl/parser"
+	"github.com/seapvnk/qokl/storage"
 )
 
+var ErrQueueEmpty = errors.New("queue is empty")
+
+// errDrainDone ends drainPrefix, keys from the one it is returned for are left as they are
+var errDrainDone = errors.New("drain done")
+
 func queueKey(name string, index uint64) []byte {
 	return []byte(fmt.Sprintf("queue.%s.%020d", name, index))
 }
@@ -17,6 +29,101 @@ func metaKey(name, label string) []byte {
 	return []byte(fmt.Sprintf("queue.%s.meta.%s", name, label))
 }
 
+func inflightKey(name string, index uint64) []byte {
+	return []byte(fmt.Sprintf("inflight.%s.%020d", name, index))
+}
+
+// delayed jobs are sorted by the time they are due, across queues
+func delayedKey(readyAt time.Time) []byte {
+	return []byte(fmt.Sprintf("delayed.%020d.%s", readyAt.UnixNano(), uuid.NewString()))
+}
+
+func deadKey(name string, index uint64) []byte {
+	return []byte(fmt.Sprintf("dead.%s.%020d", name, index))
+}
+
+func deadQuery(name string) []byte {
+	return []byte(fmt.Sprintf("dead.%s.", name))
+}
+
+// indexOf parses the index ending a key of prefix, false when the rest of the key is not
+// exactly an index, like the keys of a queue whose name extends the one of prefix
+func indexOf(key []byte, prefix []byte) (uint64, bool) {
+	rest := strings.TrimPrefix(string(key), string(prefix))
+	if len(rest) != 20 {
+		return 0, false
+	}
+
+	index, err := strconv.ParseUint(rest, 10, 64)
+	return index, err == nil
+}
+
+// Job a message reserved from a queue, it stays in flight until acked or failed.
+// ScheduledAt is the slot of the cron schedule that queued it, zero otherwise.
+// Workflow and Step name the workflow step the job runs, if any.
+type Job struct {
+	ID          string
+	Queue       string
+	Priority    int
+	Index       uint64
+	Msg         []byte
+	Attempts    int
+	LastError   string
+	ScheduledAt time.Time
+	Workflow    string
+	Step        string
+	// set when the job is a record consumed from a stream
+	Stream string
+	Offset uint64
+}
+
+// envelope a message as stored in queues, with its delivery state
+type envelope struct {
+	ID          string    `json:"id,omitempty"`
+	Queue       string    `json:"queue"`
+	Msg         []byte    `json:"msg"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"`
+	ScheduledAt time.Time `json:"scheduledAt,omitzero"`
+	Priority    int       `json:"priority,omitempty"`
+	EnqueuedAt  time.Time `json:"enqueuedAt,omitzero"`
+	Workflow    string    `json:"workflow,omitempty"`
+	Step        string    `json:"step,omitempty"`
+}
+
+// jobOf the job of a message stored at index of a priority lane
+func jobOf(msg envelope, priority int, index uint64) *Job {
+	return &Job{
+		ID:          msg.ID,
+		Queue:       msg.Queue,
+		Priority:    priority,
+		Index:       index,
+		Msg:         msg.Msg,
+		Attempts:    msg.Attempts,
+		LastError:   msg.Error,
+		ScheduledAt: msg.ScheduledAt,
+		Workflow:    msg.Workflow,
+		Step:        msg.Step,
+	}
+}
+
+func encodeEnvelope(env envelope) ([]byte, error) {
+	return json.Marshal(env)
+}
+
+// decodeEnvelope reads a stored message, raw messages queued by older versions are wrapped
+func decodeEnvelope(queueName string, data []byte) envelope {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return envelope{Queue: queueName, Msg: data}
+	}
+
+	if env.Queue == "" {
+		env.Queue = queueName
+	}
+	return env
+}
+
 func uint64ToBytes(n uint64) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, n)
@@ -27,13 +134,19 @@ func bytesToUint64(b []byte) uint64 {
 	return binary.BigEndian.Uint64(b)
 }
 
-// fnDispatch adds a message to a queue
-// Lisp: (dispatch aQueue: (msgpack(hash key1: "value" key2: "value")))
+// fnDispatch adds a message to a queue, higher priorities are served first.
+// Returns the id of the job, see jobStatus. Inside an entity transaction it is queued once that commits.
+// Lisp: (dispatch aQueue: (msgpack(hash key1: "value" key2: "value")) priority: 10)
 func fnDispatch(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return zygo.SexpNull, zygo.WrongNargs
 	}
 
+	priority, err := priorityOption(args[2:])
+	if err != nil {
+		return zygo.SexpNull, fmt.Errorf("dispatch: %w", err)
+	}
+
 	queueName, ok := args[0].(*zygo.SexpSymbol)
 	if !ok {
 		return zygo.SexpNull, errors.New("dispatch: first arg must be symbol")
@@ -44,59 +157,424 @@ func fnDispatch(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, erro
 		return zygo.SexpNull, errors.New("dispatch: second arg must serialized hash, use json function")
 	}
 
-	err := store.Update(func(txn *badger.Txn) error {
-		// read tail
-		var tail uint64
-		item, err := txn.Get(metaKey(queueName.Name(), "tail"))
-		if err == nil {
-			val, _ := item.ValueCopy(nil)
-			tail = bytesToUint64(val)
+	msg := envelope{ID: uuid.NewString(), Queue: queueName.Name(), Msg: value.Val, Priority: priority}
+	if storage.InTransaction(env) {
+		return toOutbox(env, msg, time.Time{})
+	}
+
+	err = store.Update(func(txn *badger.Txn) error {
+		return enqueue(txn, msg)
+	})
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	notifyQueued()
+	return &zygo.SexpStr{S: msg.ID}, nil
+}
+
+// priorityOption reads the priority: option of a dispatch, 0 by default
+func priorityOption(args []zygo.Sexp) (int, error) {
+	options, err := parser.Options(args)
+	if err != nil {
+		return 0, err
+	}
+
+	option, ok := options["priority"]
+	if !ok {
+		return 0, nil
+	}
+
+	priority, ok := option.(*zygo.SexpInt)
+	if !ok {
+		return 0, errors.New("priority must be an integer")
+	}
+
+	return int(priority.Val), nil
+}
+
+// fnDispatchAt adds a message to a queue once a time is reached, the time can be a
+// time value, unix seconds or an RFC 3339 string
+// Lisp: (dispatchAt aQueue: (now) (msgpack (hash key1: "value")) priority: 10)
+func fnDispatchAt(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 3 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	var readyAt time.Time
+	switch at := args[1].(type) {
+	case *zygo.SexpTime:
+		readyAt = at.Tm
+	case *zygo.SexpInt:
+		readyAt = time.Unix(at.Val, 0)
+	case *zygo.SexpStr:
+		var err error
+		if readyAt, err = time.Parse(time.RFC3339, at.S); err != nil {
+			return zygo.SexpNull, fmt.Errorf("dispatchAt: %w", err)
 		}
+	default:
+		return zygo.SexpNull, errors.New("dispatchAt: second arg must be a time, unix seconds or an RFC 3339 string")
+	}
+
+	return dispatchLater(env, name, args[0], args[2], args[3:], readyAt)
+}
+
+// fnDispatchIn adds a message to a queue after a number of seconds
+// Lisp: (dispatchIn aQueue: 300 (msgpack (hash key1: "value")) priority: 10)
+func fnDispatchIn(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 3 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	var delay time.Duration
+	switch seconds := args[1].(type) {
+	case *zygo.SexpInt:
+		delay = time.Duration(seconds.Val) * time.Second
+	case *zygo.SexpFloat:
+		delay = time.Duration(seconds.Val * float64(time.Second))
+	default:
+		return zygo.SexpNull, errors.New("dispatchIn: second arg must be a number of seconds")
+	}
+
+	return dispatchLater(env, name, args[0], args[2], args[3:], time.Now().Add(delay))
+}
 
-		// write new entry
-		if err := txn.Set(queueKey(queueName.Name(), tail), value.Val); err != nil {
+func dispatchLater(env *zygo.Zlisp, name string, queueArg zygo.Sexp, msgArg zygo.Sexp, optionArgs []zygo.Sexp, readyAt time.Time) (zygo.Sexp, error) {
+	queueName, ok := queueArg.(*zygo.SexpSymbol)
+	if !ok {
+		return zygo.SexpNull, fmt.Errorf("%s: first arg must be symbol", name)
+	}
+
+	value, ok := msgArg.(*zygo.SexpRaw)
+	if !ok {
+		return zygo.SexpNull, fmt.Errorf("%s: last arg must serialized hash, use msgpack function", name)
+	}
+
+	priority, err := priorityOption(optionArgs)
+	if err != nil {
+		return zygo.SexpNull, fmt.Errorf("%s: %w", name, err)
+	}
+
+	msg := envelope{ID: uuid.NewString(), Queue: queueName.Name(), Msg: value.Val, Priority: priority}
+	if storage.InTransaction(env) {
+		return toOutbox(env, msg, readyAt)
+	}
+
+	err = store.Update(func(txn *badger.Txn) error {
+		return schedule(txn, msg, readyAt)
+	})
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	notifyQueued()
+	return &zygo.SexpStr{S: msg.ID}, nil
+}
+
+// enqueue appends a message at the tail of the lane of its priority
+func enqueue(txn *badger.Txn, msg envelope) error {
+	msg.EnqueuedAt = time.Now()
+	data, err := encodeEnvelope(msg)
+	if err != nil {
+		return err
+	}
+
+	lane := laneName(msg.Queue, msg.Priority)
+	if msg.Priority != 0 {
+		if err := txn.Set(laneKey(msg.Queue, msg.Priority), []byte("1")); err != nil {
 			return err
 		}
+	}
 
-		// increment tail
-		return txn.Set(metaKey(queueName.Name(), "tail"), uint64ToBytes(tail+1))
-	})
+	// read tail
+	var tail uint64
+	item, err := txn.Get(metaKey(lane, "tail"))
+	if err == nil {
+		val, _ := item.ValueCopy(nil)
+		tail = bytesToUint64(val)
+	}
+
+	// write new entry
+	if err := txn.Set(queueKey(lane, tail), data); err != nil {
+		return err
+	}
+
+	// increment tail
+	if err := txn.Set(metaKey(lane, "tail"), uint64ToBytes(tail+1)); err != nil {
+		return err
+	}
 
-	return zygo.SexpNull, err
+	return markQueued(txn, msg)
 }
 
-// Dequeue gets and deletes the oldest message
+// schedule keeps a message aside until readyAt, StorePromoteDue queues it afterwards
+func schedule(txn *badger.Txn, msg envelope, readyAt time.Time) error {
+	data, err := encodeEnvelope(msg)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Set(delayedKey(readyAt), data); err != nil {
+		return err
+	}
+
+	return markQueued(txn, msg)
+}
+
+// StoreDequeue gets and deletes the next message, urgent ones first
 func StoreDequeue(queueName string) ([]byte, error) {
-	var value []byte
+	job, err := StoreReserve(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	return job.Msg, StoreAck(job)
+}
+
+// StoreReserve moves the next message of a queue in flight, counting an attempt.
+// It is queued again on startup unless acked or failed.
+func StoreReserve(queueName string) (*Job, error) {
+	var job *Job
 
 	err := store.Update(func(txn *badger.Txn) error {
-		// read head
-		var head uint64
-		item, err := txn.Get(metaKey(queueName, "head"))
-		if err == nil {
-			val, _ := item.ValueCopy(nil)
-			head = bytesToUint64(val)
-		}
+		var err error
+		job, err = reserve(txn, queueName)
+		return err
+	})
 
-		key := queueKey(queueName, head)
-		item, err = txn.Get(key)
-		if err == badger.ErrKeyNotFound {
-			return fmt.Errorf("queue %s is empty", queueName)
-		} else if err != nil {
-			return err
+	return job, err
+}
+
+func reserve(txn *badger.Txn, queueName string) (*Job, error) {
+	if isPaused(txn, queueName) {
+		return nil, fmt.Errorf("queue %s is paused", queueName)
+	}
+
+	priority, found := pickLane(txn, queueName, time.Now())
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrQueueEmpty, queueName)
+	}
+
+	lane := laneName(queueName, priority)
+	head := laneHead(txn, lane)
+
+	key := queueKey(lane, head)
+	item, err := txn.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := decodeEnvelope(queueName, value)
+	msg.Attempts++
+	data, err := encodeEnvelope(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := txn.Delete(key); err != nil {
+		return nil, err
+	}
+
+	if err := txn.Set(inflightKey(lane, head), data); err != nil {
+		return nil, err
+	}
+
+	if err := txn.Set(metaKey(lane, "head"), uint64ToBytes(head+1)); err != nil {
+		return nil, err
+	}
+
+	err = updateStatus(txn, msg.ID, queueName, func(status *JobStatus) {
+		now := time.Now()
+		status.Status = JobRunning
+		status.Attempts = msg.Attempts
+		status.StartedAt = &now
+	})
+
+	return jobOf(msg, priority, head), err
+}
+
+// StoreAck removes a job from flight once it is handled
+func StoreAck(job *Job) error {
+	return StoreComplete(job, nil)
+}
+
+// StoreFail removes a failed job from flight, it is retried after delay or moved
+// to the dead letters of its queue once it ran maxAttempts times
+func StoreFail(job *Job, cause error, maxAttempts int, delay time.Duration) error {
+	err := updateRetrying(func(txn *badger.Txn) error {
+		return fail(txn, job, cause, maxAttempts, delay)
+	})
+	if err == nil {
+		notifyQueued()
+	}
+
+	return err
+}
+
+func fail(txn *badger.Txn, job *Job, cause error, maxAttempts int, delay time.Duration) error {
+	if err := txn.Delete(inflightKey(laneName(job.Queue, job.Priority), job.Index)); err != nil {
+		return err
+	}
+
+	msg := envelope{
+		ID:          job.ID,
+		Queue:       job.Queue,
+		Msg:         job.Msg,
+		Attempts:    job.Attempts,
+		Error:       cause.Error(),
+		ScheduledAt: job.ScheduledAt,
+		Priority:    job.Priority,
+		Workflow:    job.Workflow,
+		Step:        job.Step,
+	}
+	if job.Attempts < maxAttempts {
+		return schedule(txn, msg, time.Now().Add(delay))
+	}
+
+	data, err := encodeEnvelope(msg)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Set(deadKey(job.Queue, uint64(time.Now().UnixNano())), data); err != nil {
+		return err
+	}
+
+	if err := cronDone(txn, job.Queue, job.ScheduledAt); err != nil {
+		return err
+	}
+
+	err = updateStatus(txn, job.ID, job.Queue, func(status *JobStatus) {
+		now := time.Now()
+		status.Status = JobFailed
+		status.Error = msg.Error
+		status.FinishedAt = &now
+	})
+	if err != nil || job.Workflow == "" {
+		return err
+	}
+
+	return stepDone(txn, job, StepFailed, nil, msg.Error)
+}
+
+// StorePromoteDue queues the delayed messages due at now, returns how many were queued
+func StorePromoteDue(now time.Time) (int, error) {
+	prefix := []byte("delayed.")
+
+	promoted, err := drainPrefix(prefix, func(txn *badger.Txn, key, value []byte) (bool, error) {
+		due, _, _ := strings.Cut(strings.TrimPrefix(string(key), string(prefix)), ".")
+		readyAt, err := strconv.ParseInt(due, 10, 64)
+		if err != nil || readyAt > now.UnixNano() {
+			return false, errDrainDone
 		}
 
-		value, err = item.ValueCopy(nil)
-		if err != nil {
-			return err
+		var msg envelope
+		if err := json.Unmarshal(value, &msg); err != nil {
+			return false, nil
 		}
 
-		if err := txn.Delete(key); err != nil {
-			return err
+		return true, enqueue(txn, msg)
+	})
+	if promoted > 0 {
+		notifyQueued()
+	}
+
+	return promoted, err
+}
+
+// recoverInflight queues again the jobs that were never acked, at the tail of their queue.
+// Leased jobs are left to their lease.
+func recoverInflight() (int, error) {
+	prefix := []byte("inflight.")
+
+	var leased map[string]bool
+	err := store.View(func(txn *badger.Txn) error {
+		var err error
+		leased, err = leasedKeys(txn)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return drainPrefix(prefix, func(txn *badger.Txn, key, value []byte) (bool, error) {
+		name := strings.TrimPrefix(string(key), string(prefix))
+		sep := strings.LastIndex(name, ".")
+		if sep < 0 || leased[string(key)] {
+			return false, nil
 		}
 
-		return txn.Set(metaKey(queueName, "head"), uint64ToBytes(head+1))
+		return true, enqueue(txn, decodeEnvelope(name[:sep], value))
 	})
+}
+
+// drainPrefix passes the keys under prefix to fn in transactions of queueBatchSize keys, deleting
+// the ones fn takes. errDrainDone from fn ends the walk before its key. Returns how many were taken.
+func drainPrefix(prefix []byte, fn func(txn *badger.Txn, key, value []byte) (bool, error)) (int, error) {
+	drained := 0
+	seek := prefix
+
+	for {
+		count, done := 0, false
+		var next []byte
+
+		err := updateRetrying(func(txn *badger.Txn) error {
+			count, done, next = 0, false, nil
+
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+
+			var keys, values [][]byte
+			for it.Seek(seek); it.ValidForPrefix(prefix) && len(keys) < queueBatchSize; it.Next() {
+				value, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
 
-	return value, err
+				keys = append(keys, it.Item().KeyCopy(nil))
+				values = append(values, value)
+			}
+			done = len(keys) < queueBatchSize
+
+			for i, key := range keys {
+				taken, err := fn(txn, key, values[i])
+				if errors.Is(err, errDrainDone) {
+					done = true
+					return nil
+				}
+
+				if err != nil {
+					return err
+				}
+
+				if taken {
+					if err := txn.Delete(key); err != nil {
+						return err
+					}
+					count++
+				}
+			}
+
+			// keys left behind are not walked again
+			if len(keys) > 0 {
+				next = append(keys[len(keys)-1], 0)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return drained, err
+		}
+
+		drained += count
+		if done {
+			return drained, nil
+		}
+		seek = next
+	}
 }
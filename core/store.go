@@ -2,29 +2,92 @@ package core
 
 import (
 	"log"
+	"os"
 
 	badger "github.com/dgraph-io/badger/v4"
+	"github.com/seapvnk/qokl/storage"
 )
 
-var store *badger.DB
+var (
+	store            *badger.DB
+	storeMaintenance *storage.Maintenance
+)
 
+// OpenStore opens the store of queues and cache, persistent at QOKL_CORE_STORE when set
+// and encrypted like the entity storage. Jobs left in flight by a crash are queued again.
 func OpenStore() {
-	var err error
-	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true))
+	opts := badger.DefaultOptions("").WithInMemory(true)
+	if path := StorePath(); path != "" {
+		var err error
+		opts, err = storage.WithEncryption(badger.DefaultOptions(path))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	db, err := badger.Open(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	store = db
+	storeMaintenance, err = storage.NewMaintenance(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storeMaintenance.Start()
+
+	recovered, err := recoverInflight()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if recovered > 0 {
+		log.Printf("%d in-flight jobs queued again", recovered)
+	}
+
+	RelayOutbox()
+}
+
+// StorePath returns the directory of the persistent core store, empty when it is in memory
+func StorePath() string {
+	return os.Getenv(coreStoreEnv)
 }
 
 // Store module setup
 func (vm *VM) UseStoreModule() *VM {
 	vm.environment.AddFunction("dispatch", fnDispatch)
+	vm.environment.AddFunction("dispatchAt", fnDispatchAt)
+	vm.environment.AddFunction("dispatchIn", fnDispatchIn)
+	vm.environment.AddFunction("deadLetters", fnDeadLetters)
+	vm.environment.AddFunction("replayDeadLetters", fnReplayDeadLetters)
+	vm.environment.AddFunction("publish", fnPublish)
+	vm.environment.AddFunction("subscribers", fnSubscribers)
+	vm.environment.AddFunction("jobStatus", fnJobStatus)
+	vm.environment.AddFunction("startWorkflow", fnStartWorkflow)
+	vm.environment.AddFunction("workflowStatus", fnWorkflowStatus)
+	vm.environment.AddFunction("queues", fnQueues)
+	vm.environment.AddFunction("queueLength", fnQueueLength)
+	vm.environment.AddFunction("peekQueue", fnPeekQueue)
+	vm.environment.AddFunction("listQueue", fnListQueue)
+	vm.environment.AddFunction("purgeQueue", fnPurgeQueue)
+	vm.environment.AddFunction("moveQueue", fnMoveQueue)
+	vm.environment.AddFunction("pauseQueue", fnPauseQueue)
+	vm.environment.AddFunction("resumeQueue", fnResumeQueue)
+	vm.environment.AddFunction("appendStream", fnAppendStream)
+	vm.environment.AddFunction("readStream", fnReadStream)
+	vm.environment.AddFunction("readGroup", fnReadGroup)
+	vm.environment.AddFunction("commitOffset", fnCommitOffset)
+	vm.environment.AddFunction("retainStream", fnRetainStream)
+	vm.environment.AddFunction("streamInfo", fnStreamInfo)
 
 	return vm.UseCacheModule()
 }
 
 func CloseStore() {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	storeMaintenance.Stop()
 	store.Close()
 }
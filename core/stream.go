@@ -0,0 +1,63 @@
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+// Stream writes values as newline delimited JSON
+type Stream struct {
+	w       io.Writer
+	emitted int
+}
+
+// UseStreamModule registers emit, each emitted value is written and flushed to w
+func (vm *VM) UseStreamModule(w io.Writer) *VM {
+	vm.stream = &Stream{w: w}
+	vm.environment.AddFunction("emit", vm.stream.fnEmit)
+
+	return vm
+}
+
+// Stream returns the stream of the VM, nil if the stream module is not in use
+func (vm *VM) Stream() *Stream {
+	return vm.stream
+}
+
+// Emitted count of values written so far
+func (stream *Stream) Emitted() int {
+	return stream.emitted
+}
+
+// Emit writes a value as a JSON line
+func (stream *Stream) Emit(value any) error {
+	if err := json.NewEncoder(stream.w).Encode(value); err != nil {
+		return err
+	}
+
+	if flusher, ok := stream.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	stream.emitted++
+
+	return nil
+}
+
+// fnEmit writes a value to the response stream
+// Lisp: (emit (hash name: "Pedro"))
+func (stream *Stream) fnEmit(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 1 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	value, err := parser.SexpToGo(args[0])
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	return zygo.SexpNull, stream.Emit(value)
+}
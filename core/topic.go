@@ -0,0 +1,193 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/google/uuid"
+	"github.com/seapvnk/qokl/parser"
+	"github.com/seapvnk/qokl/storage"
+)
+
+// a subscriber queue is named <topic>/<handler>, like the task tasks/user.created/audit.lisp
+func subscriptionKey(queueName string) []byte {
+	return []byte("topic." + queueName)
+}
+
+func subscriptionQuery(topic string) []byte {
+	return []byte("topic." + topic + "/")
+}
+
+// fnPublish queues a copy of a message for every handler subscribed to a topic, each
+// with its own queue and retries. Returns the job ids, messages without subscribers are dropped.
+// Inside an entity transaction the copies are queued once that commits.
+// Lisp: (publish user.created: (msgpack (hash id: 1)) priority: 10)
+func fnPublish(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 2 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	topic, ok := args[0].(*zygo.SexpSymbol)
+	if !ok {
+		return zygo.SexpNull, errors.New("publish: first arg must be symbol")
+	}
+
+	value, ok := args[1].(*zygo.SexpRaw)
+	if !ok {
+		return zygo.SexpNull, errors.New("publish: second arg must serialized hash, use msgpack function")
+	}
+
+	priority, err := priorityOption(args[2:])
+	if err != nil {
+		return zygo.SexpNull, fmt.Errorf("publish: %w", err)
+	}
+
+	if storage.InTransaction(env) {
+		return publishToOutbox(env, topic.Name(), value.Val, priority)
+	}
+
+	ids, err := StorePublish(topic.Name(), value.Val, priority)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.ToSexp(env, ids), nil
+}
+
+// fnSubscribers lists the queues subscribed to a topic
+// Lisp: (subscribers user.created:)
+func fnSubscribers(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	topic, err := queueArg(name, args, 1)
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	queues, err := StoreSubscribers(topic)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.ToSexp(env, queues), nil
+}
+
+// publishToOutbox records a copy of msg for every current subscriber in the entity transaction of env
+func publishToOutbox(env *zygo.Zlisp, topic string, msg []byte, priority int) (zygo.Sexp, error) {
+	queues, err := StoreSubscribers(topic)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	ids := []string{}
+	for _, queueName := range queues {
+		id := uuid.NewString()
+		if _, err := toOutbox(env, envelope{ID: id, Queue: queueName, Msg: msg, Priority: priority}, time.Time{}); err != nil {
+			return parser.SignalErr(env, err)
+		}
+		ids = append(ids, id)
+	}
+
+	return parser.ToSexp(env, ids), nil
+}
+
+// StorePublish queues msg in every queue subscribed to topic, returns the job ids
+func StorePublish(topic string, msg []byte, priority int) ([]string, error) {
+	ids := []string{}
+
+	err := store.Update(func(txn *badger.Txn) error {
+		for _, queueName := range subscribers(txn, topic) {
+			id := uuid.NewString()
+			if err := enqueue(txn, envelope{ID: id, Queue: queueName, Msg: msg, Priority: priority}); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		notifyQueued()
+	}
+
+	return ids, nil
+}
+
+// StoreSubscribers lists the queues subscribed to a topic
+func StoreSubscribers(topic string) ([]string, error) {
+	var queues []string
+
+	err := store.View(func(txn *badger.Txn) error {
+		queues = subscribers(txn, topic)
+		return nil
+	})
+
+	return queues, err
+}
+
+// StoreSetSubscriptions replaces the subscriber queues of every topic,
+// queues are named <topic>/<handler>
+func StoreSetSubscriptions(queues []string) error {
+	return store.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte("topic.")
+		var stale [][]byte
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			queueName := strings.TrimPrefix(string(it.Item().Key()), string(prefix))
+			if !slices.Contains(queues, queueName) {
+				stale = append(stale, it.Item().KeyCopy(nil))
+			}
+		}
+
+		for _, key := range stale {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		for _, queueName := range queues {
+			if !strings.Contains(queueName, "/") {
+				return fmt.Errorf("subscriber queue %s must be named <topic>/<handler>", queueName)
+			}
+
+			if err := txn.Set(subscriptionKey(queueName), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func subscribers(txn *badger.Txn, topic string) []string {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	queues := []string{}
+	query := subscriptionQuery(topic)
+	for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+		handler := strings.TrimPrefix(string(it.Item().Key()), string(query))
+
+		// handlers of nested topics
+		if strings.Contains(handler, "/") {
+			continue
+		}
+
+		queues = append(queues, topic+"/"+handler)
+	}
+
+	return queues
+}
@@ -15,6 +15,8 @@ type ZygResult struct {
 
 type VM struct {
 	environment *zygo.Zlisp
+	stream      *Stream
+	release     []func()
 }
 
 func NewVM() *VM {
@@ -0,0 +1,444 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/google/uuid"
+	"github.com/seapvnk/qokl/parser"
+)
+
+/*
+* # Workflows
+*
+* a workflow runs tasks as steps, each step waits for the steps listed in after:
+*
+* (startWorkflow [(hash name: %resize)
+*                 (hash name: %upload after: [%resize])
+*                 (hash name: %thumbs after: [%resize])
+*                 (hash name: %notify task: %mail after: [%upload %thumbs] onFailure: %continue)]
+*                (msgpack (hash image: "cat.png")))
+*
+* steps fan out when several wait for the same step and fan in when one waits for
+* several. Their task defaults to the step name, it receives the workflow input as
+* msg and the results of the steps done so far in results.
+*
+* a step fails once its job runs out of attempts, with onFailure: %fail (default) the
+* steps waiting for it are skipped and the workflow fails, with %continue they run anyway.
+ */
+
+const (
+	WorkflowRunning   = "running"
+	WorkflowSucceeded = "succeeded"
+	WorkflowFailed    = "failed"
+
+	StepPending   = "pending"
+	StepQueued    = "queued"
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+
+	onFailureFail     = "fail"
+	onFailureContinue = "continue"
+)
+
+var ErrWorkflowNotFound = errors.New("workflow not found")
+
+// Workflow progress of the steps of a started workflow
+type Workflow struct {
+	ID         string         `json:"id"`
+	Status     string         `json:"status"`
+	Input      []byte         `json:"input"`
+	Steps      []WorkflowStep `json:"steps"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+}
+
+// WorkflowStep a task of a workflow and the steps it waits for
+type WorkflowStep struct {
+	Name      string   `json:"name"`
+	Task      string   `json:"task"`
+	After     []string `json:"after,omitempty"`
+	OnFailure string   `json:"onFailure"`
+	Status    string   `json:"status"`
+	JobID     string   `json:"jobId,omitempty"`
+	Result    any      `json:"result,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func workflowKey(id string) []byte {
+	return []byte("workflow." + id)
+}
+
+// fnStartWorkflow starts a workflow, returns its id
+// Lisp: (startWorkflow [(hash name: %resize) (hash name: %upload after: [%resize])] (msgpack (hash image: "cat.png")))
+func fnStartWorkflow(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 2 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	steps, ok := args[0].(*zygo.SexpArray)
+	if !ok {
+		return zygo.SexpNull, errors.New("startWorkflow: first arg must be an array of steps")
+	}
+
+	input, ok := args[1].(*zygo.SexpRaw)
+	if !ok {
+		return zygo.SexpNull, errors.New("startWorkflow: second arg must serialized hash, use msgpack function")
+	}
+
+	workflowSteps := make([]WorkflowStep, 0, len(steps.Val))
+	for _, sexp := range steps.Val {
+		step, err := stepOf(sexp)
+		if err != nil {
+			return zygo.SexpNull, fmt.Errorf("startWorkflow: %w", err)
+		}
+		workflowSteps = append(workflowSteps, step)
+	}
+
+	id, err := StoreStartWorkflow(workflowSteps, input.Val)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return &zygo.SexpStr{S: id}, nil
+}
+
+// fnWorkflowStatus returns the progress of a workflow, nil when it is unknown
+// Lisp: (workflowStatus id)
+func fnWorkflowStatus(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 1 {
+		return zygo.SexpNull, zygo.WrongNargs
+	}
+
+	id, ok := args[0].(*zygo.SexpStr)
+	if !ok {
+		return zygo.SexpNull, errors.New("workflowStatus: first arg must be a workflow id string")
+	}
+
+	workflow, err := StoreWorkflow(id.S)
+	if errors.Is(err, ErrWorkflowNotFound) {
+		return zygo.SexpNull, nil
+	}
+
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	steps := map[string]any{}
+	for _, step := range workflow.Steps {
+		row := map[string]any{"status": step.Status, "task": step.Task}
+		if step.JobID != "" {
+			row["jobId"] = step.JobID
+		}
+		if step.Result != nil {
+			row["result"] = step.Result
+		}
+		if step.Error != "" {
+			row["error"] = step.Error
+		}
+		steps[step.Name] = row
+	}
+
+	return parser.ToSexp(env, map[string]any{
+		"id":     workflow.ID,
+		"status": workflow.Status,
+		"steps":  steps,
+	}), nil
+}
+
+// stepOf reads a step declared as (hash name: %upload task: %s3 after: [%resize] onFailure: %continue)
+func stepOf(sexp zygo.Sexp) (WorkflowStep, error) {
+	step := WorkflowStep{OnFailure: onFailureFail, Status: StepPending}
+
+	hash, ok := sexp.(*zygo.SexpHash)
+	if !ok {
+		return step, errors.New("steps must be hashes")
+	}
+
+	for _, pairs := range hash.Map {
+		for _, pair := range pairs {
+			key, ok := pair.Head.(*zygo.SexpSymbol)
+			if !ok {
+				continue
+			}
+
+			switch key.Name() {
+			case "name":
+				step.Name = nameOf(pair.Tail)
+			case "task":
+				step.Task = nameOf(pair.Tail)
+			case "onFailure":
+				step.OnFailure = nameOf(pair.Tail)
+			case "after":
+				after, ok := pair.Tail.(*zygo.SexpArray)
+				if !ok {
+					return step, fmt.Errorf("after of step %s must be an array", step.Name)
+				}
+
+				for _, dependency := range after.Val {
+					step.After = append(step.After, nameOf(dependency))
+				}
+			}
+		}
+	}
+
+	if step.Task == "" {
+		step.Task = step.Name
+	}
+
+	return step, nil
+}
+
+// nameOf the name of a symbol or string, empty for other values
+func nameOf(sexp zygo.Sexp) string {
+	switch value := sexp.(type) {
+	case *zygo.SexpSymbol:
+		return value.Name()
+	case *zygo.SexpStr:
+		return value.S
+	}
+
+	return ""
+}
+
+// StoreStartWorkflow validates the steps of a workflow and queues the ones waiting for no other
+func StoreStartWorkflow(steps []WorkflowStep, input []byte) (string, error) {
+	if err := validateSteps(steps); err != nil {
+		return "", err
+	}
+
+	workflow := &Workflow{
+		ID:        uuid.NewString(),
+		Status:    WorkflowRunning,
+		Input:     input,
+		Steps:     steps,
+		CreatedAt: time.Now(),
+	}
+
+	err := store.Update(func(txn *badger.Txn) error {
+		return advanceWorkflow(txn, workflow)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	notifyQueued()
+	return workflow.ID, nil
+}
+
+// StoreWorkflow reads the progress of a workflow
+func StoreWorkflow(id string) (*Workflow, error) {
+	var workflow *Workflow
+
+	err := store.View(func(txn *badger.Txn) error {
+		var err error
+		workflow, err = readWorkflow(txn, id)
+		return err
+	})
+
+	return workflow, err
+}
+
+// StoreWorkflowResults the results of the steps of a workflow that succeeded, by step name
+func StoreWorkflowResults(id string) (map[string]any, error) {
+	workflow, err := StoreWorkflow(id)
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[string]any{}
+	for _, step := range workflow.Steps {
+		if step.Status == StepSucceeded && step.Result != nil {
+			results[step.Name] = step.Result
+		}
+	}
+
+	return results, nil
+}
+
+func validateSteps(steps []WorkflowStep) error {
+	if len(steps) == 0 {
+		return errors.New("a workflow needs steps")
+	}
+
+	names := map[string]bool{}
+	for _, step := range steps {
+		if step.Name == "" {
+			return errors.New("workflow steps need a name")
+		}
+
+		if names[step.Name] {
+			return fmt.Errorf("workflow step %s is declared twice", step.Name)
+		}
+		names[step.Name] = true
+
+		if step.OnFailure != onFailureFail && step.OnFailure != onFailureContinue {
+			return fmt.Errorf("onFailure of step %s must be %s or %s", step.Name, onFailureFail, onFailureContinue)
+		}
+	}
+
+	// steps are done in waves, a wave without progress means a cycle
+	done := map[string]bool{}
+	for len(done) < len(steps) {
+		progress := false
+		for _, step := range steps {
+			if done[step.Name] {
+				continue
+			}
+
+			ready := true
+			for _, dependency := range step.After {
+				if !names[dependency] {
+					return fmt.Errorf("workflow step %s waits for unknown step %s", step.Name, dependency)
+				}
+				ready = ready && done[dependency]
+			}
+
+			if ready {
+				done[step.Name] = true
+				progress = true
+			}
+		}
+
+		if !progress {
+			return errors.New("workflow steps wait for each other in a cycle")
+		}
+	}
+
+	return nil
+}
+
+func readWorkflow(txn *badger.Txn, id string) (*Workflow, error) {
+	item, err := txn.Get(workflowKey(id))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrWorkflowNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var workflow Workflow
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &workflow)
+	})
+
+	return &workflow, err
+}
+
+// stepDone records the outcome of the job of a workflow step and queues the steps it unblocks
+func stepDone(txn *badger.Txn, job *Job, status string, result any, cause string) error {
+	workflow, err := readWorkflow(txn, job.Workflow)
+	if errors.Is(err, ErrWorkflowNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(workflow.Steps, func(step WorkflowStep) bool {
+		return step.Name == job.Step
+	})
+	if index < 0 || workflow.Steps[index].Status != StepQueued {
+		return nil
+	}
+
+	step := &workflow.Steps[index]
+	step.Status = status
+	step.Result = result
+	step.Error = cause
+
+	return advanceWorkflow(txn, workflow)
+}
+
+// advanceWorkflow queues the steps whose dependencies are done, skips the ones waiting for
+// a failed step and finishes the workflow once every step is done, then saves it
+func advanceWorkflow(txn *badger.Txn, workflow *Workflow) error {
+	for changed := true; changed; {
+		changed = false
+
+		for i := range workflow.Steps {
+			step := &workflow.Steps[i]
+			if step.Status != StepPending {
+				continue
+			}
+
+			ready, skip := workflow.dependenciesOf(step)
+			if skip {
+				step.Status = StepSkipped
+				changed = true
+				continue
+			}
+
+			if !ready {
+				continue
+			}
+
+			step.Status = StepQueued
+			step.JobID = uuid.NewString()
+			msg := envelope{ID: step.JobID, Queue: step.Task, Msg: workflow.Input, Workflow: workflow.ID, Step: step.Name}
+			if err := enqueue(txn, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	if workflow.Status == WorkflowRunning && workflow.finished() {
+		now := time.Now()
+		workflow.Status = WorkflowSucceeded
+		workflow.FinishedAt = &now
+
+		for _, step := range workflow.Steps {
+			if step.Status == StepSkipped || (step.Status == StepFailed && step.OnFailure == onFailureFail) {
+				workflow.Status = WorkflowFailed
+			}
+		}
+	}
+
+	data, err := json.Marshal(workflow)
+	if err != nil {
+		return err
+	}
+
+	return txn.SetEntry(badger.NewEntry(workflowKey(workflow.ID), data).WithTTL(workflowTTL))
+}
+
+// dependenciesOf reports whether the steps a step waits for are done, and whether
+// one of them failed or was skipped so the step never runs
+func (workflow *Workflow) dependenciesOf(step *WorkflowStep) (ready bool, skip bool) {
+	ready = true
+	for _, dependency := range step.After {
+		for _, other := range workflow.Steps {
+			if other.Name != dependency {
+				continue
+			}
+
+			switch {
+			case other.Status == StepSkipped, other.Status == StepFailed && other.OnFailure == onFailureFail:
+				return false, true
+			case other.Status == StepSucceeded, other.Status == StepFailed:
+			default:
+				ready = false
+			}
+		}
+	}
+
+	return ready, false
+}
+
+func (workflow *Workflow) finished() bool {
+	for _, step := range workflow.Steps {
+		if step.Status == StepPending || step.Status == StepQueued {
+			return false
+		}
+	}
+
+	return true
+}
@@ -7,6 +7,11 @@ import (
 )
 
 func main() {
+	// maintenance commands
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
 	// Init server
 	baseDir := "./"
 	if len(os.Args) > 1 {
@@ -0,0 +1,25 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+)
+
+// Options parse trailing `name: value` pairs of a function call
+func Options(args []zygo.Sexp) (map[string]zygo.Sexp, error) {
+	if len(args)%2 != 0 {
+		return nil, zygo.WrongNargs
+	}
+
+	options := make(map[string]zygo.Sexp)
+	for i := 0; i < len(args); i += 2 {
+		key, ok := args[i].(*zygo.SexpSymbol)
+		if !ok {
+			return nil, fmt.Errorf("option name must be a symbol, got %T", args[i])
+		}
+		options[key.Name()] = args[i+1]
+	}
+
+	return options, nil
+}
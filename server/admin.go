@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/seapvnk/qokl/storage"
+)
+
+type StorageResponse struct {
+	Tags          map[string]int64 `json:"tags"`
+	Relationships []string         `json:"relationships"`
+	storage.StorageStats
+}
+
+type TagResponse struct {
+	Tag        string   `json:"tag"`
+	Count      int64    `json:"count"`
+	Components []string `json:"components"`
+}
+
+func (server *Server) setupAdmin(r chi.Router) {
+	r.Use(requireAdminToken)
+	r.Get("/storage", storageHandler)
+	r.Get("/storage/tags/{tag}", storageTagHandler)
+	r.Route("/queues", server.setupQueues)
+	r.Get("/schedules", server.schedulesHandler)
+}
+
+// requireAdminToken protects admin routes with QOKL_ADMIN_TOKEN, they are forbidden when it is unset
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv(adminTokenEnv)
+		if token == "" {
+			http.Error(w, "admin routes are disabled, set "+adminTokenEnv, http.StatusForbidden)
+			return
+		}
+
+		given := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	response := StorageResponse{
+		Tags:          map[string]int64{},
+		Relationships: storage.RelationshipTypes(),
+		StorageStats:  storage.Stats(),
+	}
+
+	for _, tag := range storage.Tags() {
+		response.Tags[tag] = storage.CountTag(tag)
+	}
+
+	writeJSON(w, response)
+}
+
+func storageTagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := chi.URLParam(r, "tag")
+	writeJSON(w, TagResponse{
+		Tag:        tag,
+		Count:      storage.CountTag(tag),
+		Components: storage.ComponentsOf(tag),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
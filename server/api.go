@@ -32,7 +32,7 @@ func (server *Server) setupApi(r chi.Router) error {
 
 		route := buildRoutePath(parts[:len(parts)-1])
 
-		handler := wrapApiHandler(path)
+		handler := server.wrapApiHandler(path)
 		handler = injectRouteVars(handler, parts[1:len(parts)-1])
 
 		switch method {
@@ -54,7 +54,7 @@ func (server *Server) setupApi(r chi.Router) error {
 	})
 }
 
-func wrapApiHandler(path string) http.HandlerFunc {
+func (server *Server) wrapApiHandler(path string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// route vars
 		vars := GetRouteVars(r.Context())
@@ -78,6 +78,12 @@ func wrapApiHandler(path string) http.HandlerFunc {
 		}
 
 		vm := core.NewVM().UseCommunicationModule().UseStoreModule()
+		if !server.authenticate(w, r, vm) {
+			return
+		}
+		defer vm.Close()
+
+		stream := useStream(w, r, vm)
 		vm.AddVariables(map[string]any{
 			"method":  r.Method,
 			"params":  vars,
@@ -86,6 +92,11 @@ func wrapApiHandler(path string) http.HandlerFunc {
 		})
 
 		result, err := vm.Execute(path)
+		if stream {
+			writeStreamResult(w, vm.Stream(), result, err)
+			return
+		}
+
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/parser"
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+// principalOf runs auth.lisp with the request headers to resolve who is calling, it returns
+// a hash like (hash id: "u1" roles: ["admin"]), nil or false for anonymous callers.
+// Without auth.lisp every caller is anonymous.
+func (server *Server) principalOf(r *http.Request) (map[string]any, error) {
+	anonymous := map[string]any{"id": nil, "roles": []string{}}
+
+	path := filepath.Join(server.baseDir, authFile)
+	if _, err := os.Stat(path); err != nil {
+		return anonymous, nil
+	}
+
+	headers := map[string]string{}
+	for k, v := range r.Header {
+		if len(v) > 0 {
+			headers[k] = v[0]
+		}
+	}
+
+	vm := core.NewVM().UseStoreModule()
+	vm.AddVariables(map[string]any{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"headers": headers,
+	})
+
+	result, err := vm.Execute(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error != nil {
+		return nil, errUnauthorized
+	}
+
+	value, _ := parser.SexpToGo(result.Value)
+	principal, ok := value.(map[string]interface{})
+	if !ok {
+		return anonymous, nil
+	}
+
+	return principal, nil
+}
+
+// hasAuth tells if callers are authenticated by auth.lisp
+func (server *Server) hasAuth() bool {
+	_, err := os.Stat(filepath.Join(server.baseDir, authFile))
+	return err == nil
+}
+
+// authenticate binds the principal of the request to vm, writing an error response when it fails
+func (server *Server) authenticate(w http.ResponseWriter, r *http.Request, vm *core.VM) bool {
+	principal, err := server.principalOf(r)
+	if errors.Is(err, errUnauthorized) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	vm.SetPrincipal(principal)
+	return true
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/seapvnk/qokl/storage"
+)
+
+func (server *Server) setupBlobs(r chi.Router) {
+	r.Use(server.requirePrincipal)
+	r.Post("/", uploadBlobHandler)
+	r.Get("/{blob}", downloadBlobHandler)
+}
+
+// requirePrincipal rejects anonymous callers when auth.lisp exists, the principal is kept in the request context
+func (server *Server) requirePrincipal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := server.principalOf(r)
+		if errors.Is(err, errUnauthorized) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if principal["id"] == nil && server.hasAuth() {
+			http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	})
+}
+
+// uploadBlobHandler stores the request body as a blob, responds with its reference
+func uploadBlobHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBlobUploadSize))
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	info, err := storage.PutBlob(data, contentType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, info)
+}
+
+// downloadBlobHandler streams a blob the caller may read, range requests are served by http.ServeContent
+func downloadBlobHandler(w http.ResponseWriter, r *http.Request) {
+	reader, info, err := storage.OpenBlob(chi.URLParam(r, "blob"))
+	if errors.Is(err, storage.ErrBlobNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := storage.AllowBlobRead(principalFrom(r.Context()), info); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("ETag", `"`+info.ID+`"`)
+	http.ServeContent(w, r, "", info.Created, reader)
+}
@@ -34,7 +34,7 @@ func (server *Server) setupClient(r chi.Router) error {
 			routeParts = []string{}
 		}
 
-		handler := injectRouteVars(wrapClientHandler(path, ext), routeParts)
+		handler := injectRouteVars(server.wrapClientHandler(path, ext), routeParts)
 
 		switch ext {
 		case ".html":
@@ -50,7 +50,7 @@ func (server *Server) setupClient(r chi.Router) error {
 	})
 }
 
-func wrapClientHandler(path string, ext string) http.HandlerFunc {
+func (server *Server) wrapClientHandler(path string, ext string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch ext {
 		case ".html":
@@ -82,6 +82,11 @@ func wrapClientHandler(path string, ext string) http.HandlerFunc {
 
 			// VM with variables
 			vm := core.NewVM().UseCommunicationModule().UseStoreModule().UseClientModule()
+			if !server.authenticate(w, r, vm) {
+				return
+			}
+			defer vm.Close()
+
 			vm.AddVariables(map[string]any{
 				"method":  r.Method,
 				"params":  vars,
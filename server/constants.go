@@ -4,4 +4,20 @@ const (
 	apiDir    = "api"
 	wsDir     = "channels"
 	clientDir = "client"
+	authFile  = "auth.lisp"
+
+	adminTokenEnv = "QOKL_ADMIN_TOKEN"
+
+	ndjsonContentType = "application/x-ndjson"
+
+	// largest body accepted by POST /blobs, in bytes
+	maxBlobUploadSize = 64 << 20
+
+	// messages listed by GET /admin/queues/{queue}/messages when no limit is given
+	defaultMessagesLimit = 100
+
+	// seconds a leased job stays reserved for a worker when it gives no visibility timeout
+	defaultVisibilityTimeout = 30
+	// runs of a leased job before it is moved to the dead letters of its queue
+	defaultLeaseMaxAttempts = 3
 )
@@ -6,7 +6,10 @@ import (
 
 type contextKey string
 
-const routeVarsKey contextKey = "routeVars"
+const (
+	routeVarsKey contextKey = "routeVars"
+	principalKey contextKey = "principal"
+)
 
 func withRouteVars(ctx context.Context, vars map[string]string) context.Context {
 	return context.WithValue(ctx, routeVarsKey, vars)
@@ -19,3 +22,15 @@ func GetRouteVars(ctx context.Context) map[string]string {
 	}
 	return map[string]string{}
 }
+
+func withPrincipal(ctx context.Context, principal map[string]any) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// principalFrom returns the principal resolved for a request, anonymous when there is none
+func principalFrom(ctx context.Context) map[string]any {
+	if principal, ok := ctx.Value(principalKey).(map[string]any); ok {
+		return principal
+	}
+	return map[string]any{"id": nil, "roles": []string{}}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/go-chi/chi/v5"
+	"github.com/seapvnk/qokl/core"
+)
+
+func (server *Server) setupJobs(r chi.Router) {
+	// job ids are random UUIDs, knowing one is what allows reading its status
+	r.Get("/{job}", jobStatusHandler)
+
+	// external workers
+	r.Group(func(r chi.Router) {
+		r.Use(requireAdminToken)
+		r.Post("/{queue}/lease", leaseHandler)
+		r.Post("/{queue}/lease/{lease}/ack", ackLeaseHandler)
+		r.Post("/{queue}/lease/{lease}/nack", nackLeaseHandler)
+		r.Post("/{queue}/lease/{lease}/extend", extendLeaseHandler)
+	})
+}
+
+// LeaseRequest options of a lease, in seconds
+type LeaseRequest struct {
+	VisibilityTimeout float64 `json:"visibilityTimeout"`
+	MaxAttempts       int     `json:"maxAttempts"`
+}
+
+// NackRequest why a worker failed a job and when to retry it, in seconds
+type NackRequest struct {
+	Error string  `json:"error"`
+	Delay float64 `json:"delay"`
+}
+
+// AckRequest the result of a job done by a worker
+type AckRequest struct {
+	Result any `json:"result"`
+}
+
+// LeaseResponse a job leased by a worker, its message decoded from msgpack when possible
+type LeaseResponse struct {
+	ID        string    `json:"id"`
+	JobID     string    `json:"jobId"`
+	Queue     string    `json:"queue"`
+	Priority  int       `json:"priority"`
+	Attempts  int       `json:"attempts"`
+	Msg       any       `json:"msg"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// leaseHandler reserves the next job of a queue for a worker until its visibility
+// timeout, responds 204 when the queue is empty
+func leaseHandler(w http.ResponseWriter, r *http.Request) {
+	request := LeaseRequest{VisibilityTimeout: defaultVisibilityTimeout, MaxAttempts: defaultLeaseMaxAttempts}
+	if !decodeBody(w, r, &request) {
+		return
+	}
+
+	if request.VisibilityTimeout <= 0 || request.MaxAttempts < 1 {
+		http.Error(w, "visibilityTimeout and maxAttempts must be positive", http.StatusBadRequest)
+		return
+	}
+
+	lease, err := core.StoreLease(chi.URLParam(r, "queue"), seconds(request.VisibilityTimeout), request.MaxAttempts)
+	if errors.Is(err, core.ErrQueueEmpty) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, leaseResponseOf(lease))
+}
+
+func ackLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	var request AckRequest
+	if !decodeBody(w, r, &request) || !leaseOfQueue(w, r) {
+		return
+	}
+
+	if err := core.StoreAckLease(chi.URLParam(r, "lease"), request.Result); err != nil {
+		writeLeaseError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func nackLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	request := NackRequest{Error: "rejected by worker"}
+	if !decodeBody(w, r, &request) || !leaseOfQueue(w, r) {
+		return
+	}
+
+	if err := core.StoreNackLease(chi.URLParam(r, "lease"), errors.New(request.Error), seconds(request.Delay)); err != nil {
+		writeLeaseError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func extendLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	request := LeaseRequest{VisibilityTimeout: defaultVisibilityTimeout}
+	if !decodeBody(w, r, &request) || !leaseOfQueue(w, r) {
+		return
+	}
+
+	if request.VisibilityTimeout <= 0 {
+		http.Error(w, "visibilityTimeout must be positive", http.StatusBadRequest)
+		return
+	}
+
+	lease, err := core.StoreExtendLease(chi.URLParam(r, "lease"), seconds(request.VisibilityTimeout))
+	if err != nil {
+		writeLeaseError(w, err)
+		return
+	}
+
+	writeJSON(w, leaseResponseOf(lease))
+}
+
+// leaseOfQueue checks the lease of the url belongs to its queue, writing a 404 otherwise
+func leaseOfQueue(w http.ResponseWriter, r *http.Request) bool {
+	lease, err := core.StoreLeaseOf(chi.URLParam(r, "lease"))
+	if err == nil && lease.Job.Queue != chi.URLParam(r, "queue") {
+		err = core.ErrLeaseNotFound
+	}
+
+	if err != nil {
+		writeLeaseError(w, err)
+		return false
+	}
+
+	return true
+}
+
+func writeLeaseError(w http.ResponseWriter, err error) {
+	if errors.Is(err, core.ErrLeaseNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// decodeBody reads an optional JSON body into request, writing a 400 when it is invalid
+func decodeBody(w http.ResponseWriter, r *http.Request, request any) bool {
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
+
+func leaseResponseOf(lease *core.Lease) LeaseResponse {
+	response := LeaseResponse{
+		ID:        lease.ID,
+		JobID:     lease.Job.ID,
+		Queue:     lease.Job.Queue,
+		Priority:  lease.Job.Priority,
+		Attempts:  lease.Job.Attempts,
+		Msg:       lease.Job.Msg,
+		ExpiresAt: lease.ExpiresAt,
+	}
+
+	if msg, err := zygo.MsgpackToGo(lease.Job.Msg); err == nil {
+		response.Msg = msg
+	}
+
+	return response
+}
+
+// jobStatusHandler reports the status of a job by the id dispatch returned, for clients
+// polling long running work. The id is the capability, no other credential is required.
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := core.StoreJobStatus(chi.URLParam(r, "job"))
+	if errors.Is(err, core.ErrJobNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, status)
+}
+
+// WorkflowResponse a workflow with its input decoded from msgpack when possible
+type WorkflowResponse struct {
+	*core.Workflow
+	Input any `json:"input"`
+}
+
+// workflowStatusHandler reports the progress of the steps of a workflow by the id startWorkflow returned
+func workflowStatusHandler(w http.ResponseWriter, r *http.Request) {
+	workflow, err := core.StoreWorkflow(chi.URLParam(r, "workflow"))
+	if errors.Is(err, core.ErrWorkflowNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := WorkflowResponse{Workflow: workflow, Input: workflow.Input}
+	if input, err := zygo.MsgpackToGo(workflow.Input); err == nil {
+		response.Input = input
+	}
+
+	writeJSON(w, response)
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/go-chi/chi/v5"
+	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/tasks"
+)
+
+// MessageResponse a queued message, decoded from msgpack when possible
+type MessageResponse struct {
+	ID          string     `json:"id,omitempty"`
+	Index       uint64     `json:"index"`
+	Priority    int        `json:"priority"`
+	Attempts    int        `json:"attempts"`
+	Error       string     `json:"error,omitempty"`
+	ScheduledAt *time.Time `json:"scheduledAt,omitempty"`
+	Msg         any        `json:"msg"`
+}
+
+type CountResponse struct {
+	Queue string `json:"queue"`
+	Count int    `json:"count"`
+}
+
+func (server *Server) setupQueues(r chi.Router) {
+	r.Get("/", queuesHandler)
+	r.Get("/{queue}", queueHandler)
+	r.Get("/{queue}/peek", queuePeekHandler)
+	r.Get("/{queue}/messages", queueMessagesHandler)
+	r.Delete("/{queue}/messages", queuePurgeHandler)
+	r.Post("/{queue}/move/{to}", queueMoveHandler)
+	r.Post("/{queue}/pause", queuePauseHandler(true))
+	r.Post("/{queue}/resume", queuePauseHandler(false))
+	r.Get("/{queue}/dead", queueDeadHandler)
+	r.Post("/{queue}/dead/replay", queueReplayHandler)
+}
+
+func queuesHandler(w http.ResponseWriter, r *http.Request) {
+	queues, err := core.StoreQueues()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, queues)
+}
+
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := core.StoreQueueInfo(chi.URLParam(r, "queue"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, info)
+}
+
+func queuePeekHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := core.StorePeek(chi.URLParam(r, "queue"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if job == nil {
+		http.Error(w, "queue is empty", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, messageOf(job))
+}
+
+// queueMessagesHandler lists waiting messages, paginated by the offset and limit query params
+func queueMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultMessagesLimit
+	}
+
+	jobs, err := core.StoreList(chi.URLParam(r, "queue"), offset, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, messagesOf(jobs))
+}
+
+func queuePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	queue := chi.URLParam(r, "queue")
+	purged, err := core.StorePurge(queue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, CountResponse{Queue: queue, Count: purged})
+}
+
+func queueMoveHandler(w http.ResponseWriter, r *http.Request) {
+	to := chi.URLParam(r, "to")
+	moved, err := core.StoreMove(chi.URLParam(r, "queue"), to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, CountResponse{Queue: to, Count: moved})
+}
+
+func queuePauseHandler(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue := chi.URLParam(r, "queue")
+
+		var err error
+		if pause {
+			err = core.StorePause(queue)
+		} else {
+			err = core.StoreResume(queue)
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		queueHandler(w, r)
+	}
+}
+
+func queueDeadHandler(w http.ResponseWriter, r *http.Request) {
+	jobs, err := core.StoreDeadLetters(chi.URLParam(r, "queue"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, messagesOf(jobs))
+}
+
+func queueReplayHandler(w http.ResponseWriter, r *http.Request) {
+	queue := chi.URLParam(r, "queue")
+	replayed, err := core.StoreReplay(queue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, CountResponse{Queue: queue, Count: replayed})
+}
+
+func (server *Server) schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	schedules, err := tasks.Schedules(server.baseDir, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, schedules)
+}
+
+func messagesOf(jobs []*core.Job) []MessageResponse {
+	messages := make([]MessageResponse, 0, len(jobs))
+	for _, job := range jobs {
+		messages = append(messages, messageOf(job))
+	}
+
+	return messages
+}
+
+func messageOf(job *core.Job) MessageResponse {
+	message := MessageResponse{
+		ID:       job.ID,
+		Index:    job.Index,
+		Priority: job.Priority,
+		Attempts: job.Attempts,
+		Error:    job.LastError,
+		Msg:      job.Msg,
+	}
+
+	if !job.ScheduledAt.IsZero() {
+		message.ScheduledAt = &job.ScheduledAt
+	}
+
+	if msg, err := zygo.MsgpackToGo(job.Msg); err == nil {
+		message.Msg = msg
+	}
+
+	return message
+}
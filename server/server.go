@@ -28,7 +28,17 @@ func New(baseDir string) *Server {
 	})
 
 	// query endpoint
-	server.Router.Post("/query", queryHandler)
+	server.Router.Post("/query", server.queryHandler)
+
+	// blob upload and download
+	server.Router.Route("/blobs", server.setupBlobs)
+
+	// job status
+	server.Router.Route("/jobs", server.setupJobs)
+	server.Router.Get("/workflows/{workflow}", workflowStatusHandler)
+
+	// admin endpoints
+	server.Router.Route("/admin", server.setupAdmin)
 
 	// discover api routes
 	server.Router.Route("/api", func(r chi.Router) {
@@ -51,7 +61,7 @@ func (server *Server) Start(addr string) {
 }
 
 // server base routes handlers
-func queryHandler(w http.ResponseWriter, r *http.Request) {
+func (server *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
 	bodyBytes, errReadingBody := io.ReadAll(r.Body)
 	if errReadingBody != nil {
 		http.Error(w, "unable to read body", http.StatusBadRequest)
@@ -59,7 +69,18 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	vm := core.NewVM()
+	if !server.authenticate(w, r, vm) {
+		return
+	}
+	defer vm.Close()
+
+	stream := useStream(w, r, vm)
 	result, err := vm.ExecuteString(string(bodyBytes))
+	if stream {
+		writeStreamResult(w, vm.Stream(), result, err)
+		return
+	}
+
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
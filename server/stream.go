@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/parser"
+)
+
+// useStream enables NDJSON streaming on the VM when the client accepts it
+func useStream(w http.ResponseWriter, r *http.Request, vm *core.VM) bool {
+	if !strings.Contains(r.Header.Get("Accept"), ndjsonContentType) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", ndjsonContentType)
+	vm.UseStreamModule(w)
+
+	return true
+}
+
+// writeStreamResult finishes a streamed response, the script result is streamed
+// only when nothing was emitted, arrays are written one element per line
+func writeStreamResult(w http.ResponseWriter, stream *core.Stream, result *core.ZygResult, err error) {
+	if err != nil {
+		if stream.Emitted() == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stream.Emit(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	if result.Error != nil {
+		stream.Emit(ErrorResponse{Error: result.Error.Error()})
+		return
+	}
+
+	if stream.Emitted() > 0 {
+		return
+	}
+
+	response, _ := parser.SexpToGo(result.Value)
+	switch response := response.(type) {
+	case nil:
+	case []interface{}:
+		for _, row := range response {
+			stream.Emit(row)
+		}
+	default:
+		stream.Emit(response)
+	}
+}
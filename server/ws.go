@@ -35,13 +35,13 @@ func (server *Server) setupChannels(r chi.Router) error {
 			core.WS.HandleRequest(w, r)
 		})
 
-		initHandlers(core.WS, path)
+		server.initHandlers(core.WS, path)
 
 		return nil
 	})
 }
 
-func initHandlers(m *melody.Melody, defaultPath string) {
+func (server *Server) initHandlers(m *melody.Melody, defaultPath string) {
 	m.HandleConnect(func(s *melody.Session) {
 		connID := core.ConnID(uuid.NewString())
 		s.Set("conn_id", connID)
@@ -62,7 +62,15 @@ func initHandlers(m *melody.Melody, defaultPath string) {
 			"msg":     "",
 		}
 
-		vm := core.NewVM().UseCommunicationModule().UseStoreModule()
+		principal, err := server.principalOf(s.Request)
+		if err != nil {
+			s.Close()
+			return
+		}
+		s.Set("principal", principal)
+
+		vm := core.NewVM().UseCommunicationModule().UseStoreModule().SetPrincipal(principal)
+		defer vm.Close()
 		vm.AddVariables(input)
 		vm.Execute(defaultPath)
 	})
@@ -86,9 +94,15 @@ func initHandlers(m *melody.Melody, defaultPath string) {
 					"msg":     string(msg),
 				}
 
-				vm := core.NewVM().UseCommunicationModule().UseStoreModule()
+				principal, ok := q.Get("principal")
+				if !ok {
+					continue
+				}
+
+				vm := core.NewVM().UseCommunicationModule().UseStoreModule().SetPrincipal(principal.(map[string]any))
 				vm.AddVariables(inputQ)
 				vm.Execute(defaultPath)
+				vm.Close()
 			}
 		}
 	})
@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+/*
+* # Access control
+*
+* access/<tag>.lisp returns the rules of entities tagged with <tag>:
+*
+* (hash read: %(admin user)
+*       insert: %(admin)
+*       update: (fn [e principal] (or (hasRole principal %admin) (== (hget e %owner) (hget principal %id))))
+*       delete: %(admin))
+*
+* an operation lists the roles allowed to perform it or a predicate receiving the
+* entity and the principal, operations without rules are allowed. An entity with
+* several tags must be allowed by the rules of every tag.
+*
+* rules are enforced on environments with a principal bound, scripts without one
+* (tasks, hooks) run unrestricted. Blobs have no tags, reading them is allowed by the
+* read rule of access/blobs.lisp, a predicate receives the blob reference. Delete rules
+* (onDelete) and spatial indexes (geoIndex) apply to every caller, they can't be changed
+* with a principal bound.
+ */
+
+var ErrAccessDenied = errors.New("access denied")
+
+// tag whose rules apply to blobs
+const blobsTag = "blobs"
+
+var (
+	accessPath string
+
+	envPrincipals   = make(map[*zygo.Zlisp]map[string]any)
+	envPrincipalsMu sync.RWMutex
+
+	accessRulesCache   = make(map[string]*accessRules)
+	accessRulesCacheMu sync.Mutex
+)
+
+// accessRules rules of a tag evaluated in their own environment
+type accessRules struct {
+	env     *zygo.Zlisp
+	mu      sync.Mutex
+	ops     map[string]zygo.Sexp
+	modTime time.Time
+}
+
+// guard checks operations against the access rules for a principal,
+// a nil guard allows everything
+type guard struct {
+	principal map[string]any
+}
+
+// BindPrincipal enforces access rules for principal on storage functions called
+// from env, the returned function unbinds it
+func BindPrincipal(env *zygo.Zlisp, principal map[string]any) func() {
+	envPrincipalsMu.Lock()
+	defer envPrincipalsMu.Unlock()
+	envPrincipals[env] = principal
+
+	return func() {
+		envPrincipalsMu.Lock()
+		defer envPrincipalsMu.Unlock()
+		delete(envPrincipals, env)
+	}
+}
+
+// guardOf returns the guard of the principal bound to env, nil if there is none
+func guardOf(env *zygo.Zlisp) *guard {
+	envPrincipalsMu.RLock()
+	defer envPrincipalsMu.RUnlock()
+
+	principal, ok := envPrincipals[env]
+	if !ok {
+		return nil
+	}
+
+	return &guard{principal: principal}
+}
+
+// allow checks an operation on an entity against the rules of each of its tags
+func (g *guard) allow(op string, tags []string, obj map[string]any) error {
+	if g == nil {
+		return nil
+	}
+
+	for _, tag := range tags {
+		rules, err := rulesFor(tag)
+		if err != nil {
+			return err
+		}
+
+		if rules != nil && !rules.allows(op, obj, g.principal) {
+			return fmt.Errorf("%w: %s on %s", ErrAccessDenied, op, tag)
+		}
+	}
+
+	return nil
+}
+
+// allowSchema rejects changes to the rules shared by every caller, like delete rules and spatial indexes
+func (g *guard) allowSchema(op string) error {
+	if g == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrAccessDenied, op)
+}
+
+// allowBlob checks the read rule of blobs
+func (g *guard) allowBlob(info BlobInfo) error {
+	return g.allow(accessRead, []string{blobsTag}, map[string]any{
+		"blob":        info.ID,
+		"size":        info.Size,
+		"contentType": info.ContentType,
+	})
+}
+
+// AllowBlobRead checks if principal may read a blob
+func AllowBlobRead(principal map[string]any, info BlobInfo) error {
+	return (&guard{principal: principal}).allowBlob(info)
+}
+
+// canRead reports whether the principal bound to env may read an entity,
+// entities that can't be read are skipped by queries
+func canRead(env *zygo.Zlisp, objID string, entityHash *zygo.SexpHash) bool {
+	g := guardOf(env)
+	if g == nil {
+		return true
+	}
+
+	var err error
+	view(env, func(txn *badger.Txn) error {
+		err = g.allow(accessRead, entityTags(txn, objID), hashToGo(entityHash))
+		return nil
+	})
+
+	return err == nil
+}
+
+func (rules *accessRules) allows(op string, obj map[string]any, principal map[string]any) bool {
+	rule, ok := rules.ops[op]
+	if !ok {
+		return true
+	}
+
+	if predicate, isFunction := rule.(*zygo.SexpFunction); isFunction {
+		rules.mu.Lock()
+		defer rules.mu.Unlock()
+
+		result, err := rules.env.Apply(predicate, []zygo.Sexp{
+			parser.ToSexp(rules.env, obj),
+			parser.ToSexp(rules.env, principal),
+		})
+		if err != nil {
+			return false
+		}
+
+		allowed, isBool := result.(*zygo.SexpBool)
+		return isBool && allowed.Val
+	}
+
+	for _, role := range tagNames(rule) {
+		if hasRole(principal, role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rulesFor loads the rules of a tag, reloading them when the file changes, nil if there are none
+func rulesFor(tag string) (*accessRules, error) {
+	if accessPath == "" {
+		return nil, nil
+	}
+
+	path := filepath.Join(accessPath, tag+".lisp")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil
+	}
+
+	accessRulesCacheMu.Lock()
+	defer accessRulesCacheMu.Unlock()
+
+	if rules, ok := accessRulesCache[tag]; ok && rules.modTime.Equal(info.ModTime()) {
+		return rules, nil
+	}
+
+	rules, err := loadRules(path)
+	if err != nil {
+		return nil, err
+	}
+	rules.modTime = info.ModTime()
+	accessRulesCache[tag] = rules
+
+	return rules, nil
+}
+
+func loadRules(path string) (*accessRules, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var env *zygo.Zlisp
+	if newHookEnv != nil {
+		env = newHookEnv()
+	} else {
+		env = zygo.NewZlisp()
+		env.StandardSetup()
+		env.AddFunction("hasRole", FnHasRole)
+	}
+
+	if err := env.LoadString(string(code)); err != nil {
+		return nil, fmt.Errorf("error executing %s: %w", path, err)
+	}
+
+	out, err := env.Run()
+	if err != nil {
+		return nil, fmt.Errorf("error executing %s: %w", path, err)
+	}
+
+	hash, isHash := out.(*zygo.SexpHash)
+	if !isHash {
+		return nil, fmt.Errorf("access rules %s must return a hash", path)
+	}
+
+	rules := &accessRules{env: env, ops: map[string]zygo.Sexp{}}
+	numPairs := zygo.HashCountKeys(hash)
+	for i := 0; i < numPairs; i++ {
+		pair, err := hash.HashPairi(i)
+		if err != nil {
+			continue
+		}
+
+		op, ok := pair.Head.(*zygo.SexpSymbol)
+		if !ok {
+			continue
+		}
+
+		if value, ok := pair.Tail.(*zygo.SexpPair); ok {
+			rules.ops[op.Name()] = value.Head
+		}
+	}
+
+	return rules, nil
+}
+
+// FnHasRole check if a principal has a role
+// Lisp (hasRole principal %admin)
+func FnHasRole(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 2 {
+		return parser.SignalWrongArgs()
+	}
+
+	principal, principalOk := args[0].(*zygo.SexpHash)
+	if !principalOk {
+		return &zygo.SexpBool{Val: false}, nil
+	}
+
+	role, roleOk := args[1].(*zygo.SexpSymbol)
+	if !roleOk {
+		return parser.SignalErr(env, errors.New("role must be a symbol"))
+	}
+
+	return &zygo.SexpBool{Val: hasRole(hashToGo(principal), role.Name())}, nil
+}
+
+func hasRole(principal map[string]any, role string) bool {
+	switch roles := principal["roles"].(type) {
+	case []string:
+		return slices.Contains(roles, role)
+	case []interface{}:
+		return slices.Contains(roles, interface{}(role))
+	}
+
+	return false
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+/*
+* # Atomic operations
+*
+* (incr myEntity %views 1) // returns the new value, a missing component counts from 0
+* (decr myEntity %stock 1)
+* (appendTo myEntity %log value) // returns the new array, a missing component starts empty
+* (compareAndSet myEntity %status "pending" "paid") // returns false when the current value differs
+*
+* each operation reads and writes the component in one transaction, retried on conflicts
+* so concurrent callers never lose a write. Update hooks and access rules apply.
+ */
+
+// FnIncr add to a numeric component
+// Lisp (incr myEntity %views 1)
+func FnIncr(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	return addToComponent(env, args, 1)
+}
+
+// FnDecr subtract from a numeric component
+// Lisp (decr myEntity %stock 1)
+func FnDecr(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	return addToComponent(env, args, -1)
+}
+
+func addToComponent(env *zygo.Zlisp, args []zygo.Sexp, sign int64) (zygo.Sexp, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return parser.SignalWrongArgs()
+	}
+
+	var delta zygo.Sexp = &zygo.SexpInt{Val: 1}
+	if len(args) == 3 {
+		delta = args[2]
+	}
+
+	value, err := atomicUpdate(env, args[0], args[1], func(current any, exists bool) (any, error) {
+		if !exists {
+			current = int64(0)
+		}
+
+		switch delta := delta.(type) {
+		case *zygo.SexpInt:
+			return addNumber(current, float64(sign*delta.Val), true)
+		case *zygo.SexpFloat:
+			return addNumber(current, float64(sign)*delta.Val, false)
+		}
+
+		return nil, errors.New("delta must be a number")
+	})
+
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.ToSexp(env, value), nil
+}
+
+// addNumber keeps integers when both the current value and the delta are whole
+func addNumber(current any, delta float64, deltaIsInt bool) (any, error) {
+	var value float64
+	switch current := current.(type) {
+	case float64:
+		value = current
+	case int64:
+		value = float64(current)
+	default:
+		return nil, fmt.Errorf("component is not a number: %v", current)
+	}
+
+	result := value + delta
+	if deltaIsInt && value == math.Trunc(value) {
+		return int64(result), nil
+	}
+
+	return result, nil
+}
+
+// FnAppendTo append a value to an array component
+// Lisp (appendTo myEntity %log value)
+func FnAppendTo(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 3 {
+		return parser.SignalWrongArgs()
+	}
+
+	item, err := parser.SexpToGo(args[2])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	value, err := atomicUpdate(env, args[0], args[1], func(current any, exists bool) (any, error) {
+		if !exists || current == nil {
+			return []any{item}, nil
+		}
+
+		items, ok := current.([]any)
+		if !ok {
+			return nil, fmt.Errorf("component is not an array: %v", current)
+		}
+
+		return append(items, item), nil
+	})
+
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.ToSexp(env, value), nil
+}
+
+// FnCompareAndSet set a component only when it holds the expected value
+// Lisp (compareAndSet myEntity %status "pending" "paid")
+func FnCompareAndSet(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 4 {
+		return parser.SignalWrongArgs()
+	}
+
+	expected, err := storedForm(args[2])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	replacement, err := parser.SexpToGo(args[3])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	swapped := false
+	_, err = atomicUpdate(env, args[0], args[1], func(current any, exists bool) (any, error) {
+		swapped = reflect.DeepEqual(current, expected)
+		if !swapped {
+			return nil, errNoChange
+		}
+
+		return replacement, nil
+	})
+
+	if err != nil && !errors.Is(err, errNoChange) {
+		return parser.SignalErr(env, err)
+	}
+
+	return &zygo.SexpBool{Val: swapped}, nil
+}
+
+// errNoChange stops an atomic update without writing
+var errNoChange = errors.New("no change")
+
+// storedForm converts a value the way it reads back from storage, so it compares with stored values
+func storedForm(sexp zygo.Sexp) (any, error) {
+	value, err := parser.SexpToGo(sexp)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored any
+	err = json.Unmarshal(data, &stored)
+	return stored, err
+}
+
+// atomicUpdate reads a component and writes the value computed by fn in the same transaction,
+// retrying on conflicts. Returns the value written.
+func atomicUpdate(env *zygo.Zlisp, entityArg zygo.Sexp, componentArg zygo.Sexp, fn func(current any, exists bool) (any, error)) (any, error) {
+	objID := getEntityIDFromQuery(entityArg)
+	component, ok := componentArg.(*zygo.SexpSymbol)
+	if !ok {
+		return nil, errors.New("component must be a symbol")
+	}
+
+	g := guardOf(env)
+	var written any
+	apply := func(txn *badger.Txn) error {
+		if !entityExists(txn, objID) {
+			return fmt.Errorf("entity %s does not exist", objID)
+		}
+
+		current, exists, err := readComponent(txn, objID, component.Name())
+		if err != nil {
+			return err
+		}
+
+		value, err := fn(current, exists)
+		if err != nil {
+			return err
+		}
+
+		obj := map[string]any{component.Name(): value}
+		if err := allowUpdate(txn, g, objID, obj); err != nil {
+			return err
+		}
+
+		obj, err = updateEntity(txn, objID, obj)
+		if err != nil {
+			return err
+		}
+
+		written = obj[component.Name()]
+		return nil
+	}
+
+	if txn := txnOf(env); txn != nil {
+		err := apply(txn)
+		return written, err
+	}
+
+	var err error
+	for attempt := 0; attempt < atomicMaxRetries; attempt++ {
+		err = commit(apply)
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+	}
+
+	return written, err
+}
+
+// readComponent reads a component value, registering the read for conflict detection
+func readComponent(txn *badger.Txn, objID string, component string) (any, bool, error) {
+	item, err := txn.Get(makeEntityComponentEntry(component, objID))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	var stored StoredValue
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &stored)
+	})
+
+	return stored.Value, err == nil, err
+}
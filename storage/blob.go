@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+/*
+* # Blobs
+*
+* blobs are stored in chunks identified by the sha256 of their content, storing the
+* same content twice returns the existing blob.
+*
+* blobs.<id> // blob info, written after every chunk
+* blobc.<id>.<chunk> // chunk data
+*
+* (putBlob bytes contentType: "image/png") // returns a reference (hash blob: id size: 10 contentType: "image/png")
+* (getBlob ref) // ref can be a blob id or a reference, returns the bytes
+*
+* references are plain hashes, they can be stored as entity components. A blob keeps the
+* content type of its first upload, the reference returned for the same content uploaded
+* again carries the content type given with it.
+ */
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	ID          string    `json:"blob"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	Chunks      int       `json:"chunks"`
+	Created     time.Time `json:"created"`
+}
+
+// FnPutBlob store bytes as a blob
+// Lisp (putBlob bytes contentType: "image/png")
+func FnPutBlob(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 1 {
+		return parser.SignalWrongArgs()
+	}
+
+	var data []byte
+	switch value := args[0].(type) {
+	case *zygo.SexpRaw:
+		data = value.Val
+	case *zygo.SexpStr:
+		data = []byte(value.S)
+	default:
+		return parser.SignalErr(env, errors.New("putBlob: first arg must be bytes or a string"))
+	}
+
+	options, err := parser.Options(args[1:])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	contentType := "application/octet-stream"
+	if option, ok := options["contentType"].(*zygo.SexpStr); ok {
+		contentType = option.S
+	}
+
+	info, err := PutBlob(data, contentType)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return blobRef(env, info), nil
+}
+
+// FnGetBlob read the bytes of a blob, allowed by the read rule of access/blobs.lisp
+// Lisp (getBlob ref)
+func FnGetBlob(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 1 {
+		return parser.SignalWrongArgs()
+	}
+
+	blobID := getBlobIDFromRef(args[0])
+	reader, info, err := OpenBlob(blobID)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	if err := guardOf(env).allowBlob(info); err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return &zygo.SexpRaw{Val: data}, nil
+}
+
+func blobRef(env *zygo.Zlisp, info BlobInfo) zygo.Sexp {
+	return parser.ToSexp(env, map[string]any{
+		"blob":        info.ID,
+		"size":        info.Size,
+		"contentType": info.ContentType,
+	})
+}
+
+func getBlobIDFromRef(arg zygo.Sexp) string {
+	switch val := arg.(type) {
+	case *zygo.SexpStr:
+		return val.S
+	case *zygo.SexpHash:
+		if id, ok := hashToGo(val)["blob"].(string); ok {
+			return id
+		}
+	}
+
+	return ""
+}
+
+// PutBlob store data as a blob, chunks are written in their own batch before the blob info.
+// Content already stored is not written again, its stored info is returned with the content
+// type of the first upload, the one downloads are served with.
+func PutBlob(data []byte, contentType string) (BlobInfo, error) {
+	sum := sha256.Sum256(data)
+	blobID := hex.EncodeToString(sum[:])
+
+	if info, err := BlobInfoOf(blobID); err == nil {
+		return info, nil
+	}
+
+	info := BlobInfo{
+		ID:          blobID,
+		Size:        int64(len(data)),
+		ContentType: contentType,
+		Chunks:      (len(data) + blobChunkSize - 1) / blobChunkSize,
+		Created:     time.Now(),
+	}
+
+	batch := edb.NewWriteBatch()
+	defer batch.Cancel()
+
+	for chunk := 0; chunk < info.Chunks; chunk++ {
+		start := chunk * blobChunkSize
+		end := min(start+blobChunkSize, len(data))
+		if err := batch.Set(makeBlobChunkEntry(blobID, chunk), data[start:end]); err != nil {
+			return BlobInfo{}, err
+		}
+	}
+
+	if err := batch.Flush(); err != nil {
+		return BlobInfo{}, err
+	}
+
+	infoData, err := json.Marshal(info)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	err = edb.Update(func(txn *badger.Txn) error {
+		return txn.Set(makeBlobEntry(blobID), infoData)
+	})
+
+	return info, err
+}
+
+// BlobInfoOf read the info of a blob
+func BlobInfoOf(blobID string) (BlobInfo, error) {
+	var info BlobInfo
+	err := edb.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(makeBlobEntry(blobID))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return ErrBlobNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &info)
+		})
+	})
+
+	return info, err
+}
+
+// OpenBlob returns a reader loading the chunks of a blob as they are read
+func OpenBlob(blobID string) (*BlobReader, BlobInfo, error) {
+	info, err := BlobInfoOf(blobID)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+
+	return &BlobReader{info: info, chunk: -1}, info, nil
+}
+
+// BlobReader reads a blob, it implements io.ReadSeeker
+type BlobReader struct {
+	info   BlobInfo
+	offset int64
+	chunk  int
+	data   []byte
+}
+
+func (br *BlobReader) Read(p []byte) (int, error) {
+	if br.offset >= br.info.Size {
+		return 0, io.EOF
+	}
+
+	chunk := int(br.offset / blobChunkSize)
+	if chunk != br.chunk {
+		if err := br.load(chunk); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, br.data[br.offset-int64(chunk)*blobChunkSize:])
+	br.offset += int64(n)
+
+	return n, nil
+}
+
+func (br *BlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += br.offset
+	case io.SeekEnd:
+		offset += br.info.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	br.offset = offset
+	return offset, nil
+}
+
+func (br *BlobReader) load(chunk int) error {
+	return edb.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(makeBlobChunkEntry(br.info.ID, chunk))
+		if err != nil {
+			return fmt.Errorf("chunk %d of blob %s: %w", chunk, br.info.ID, err)
+		}
+
+		if br.data, err = item.ValueCopy(br.data[:0]); err != nil {
+			return err
+		}
+
+		br.chunk = chunk
+		return nil
+	})
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"errors"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+// BulkReport progress of a bulk operation, total counts the entities matched so far by
+// update and deleteAll so done and failed add up to it
+type BulkReport struct {
+	Total  int64       `json:"total"`
+	Done   int64       `json:"done"`
+	Failed int64       `json:"failed"`
+	Errors []BulkError `json:"errors"`
+}
+
+// BulkError an entity that could not be written
+type BulkError struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// errBulkSkip returned by a bulk write for an entity with nothing left to write,
+// it is neither done nor failed and is not counted in the total
+var errBulkSkip = errors.New("skip")
+
+// bulkWriter writes entities in batches, one transaction per batch.
+// Batches hitting badger.ErrTxnTooBig are split in half and entities failing
+// with any other error are recorded while the rest of their batch is retried.
+//
+// When env is bound to a transaction (e.g. inside a hook) every write joins it
+// and the first failure is returned, as a partial write can't be undone.
+type bulkWriter struct {
+	env       *zygo.Zlisp
+	report    BulkReport
+	batchSize int
+	progress  func(*BulkReport)
+}
+
+func newBulkWriter(env *zygo.Zlisp, total int, batchSize int, progress func(*BulkReport)) *bulkWriter {
+	return &bulkWriter{
+		env:       env,
+		report:    BulkReport{Total: int64(total), Errors: []BulkError{}},
+		batchSize: batchSize,
+		progress:  progress,
+	}
+}
+
+// write applies fn to every id, reporting progress after each committed batch
+func (bw *bulkWriter) write(ids []string, fn func(txn *badger.Txn, id string) error) error {
+	if txn := txnOf(bw.env); txn != nil {
+		for _, id := range ids {
+			err := fn(txn, id)
+			if errors.Is(err, errBulkSkip) {
+				bw.report.Total--
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+			bw.report.Done++
+		}
+
+		return nil
+	}
+
+	skip := map[string]bool{}
+	conflicts := 0
+
+	for start := 0; start < len(ids); {
+		end := min(start+bw.batchSize, len(ids))
+		batch := ids[start:end]
+
+		failedID, skipped, err := writeBatch(batch, skip, fn)
+		switch {
+		case err == nil:
+			conflicts = 0
+			for _, id := range batch {
+				if !skip[id] && !skipped[id] {
+					bw.report.Done++
+				}
+			}
+			bw.report.Total -= int64(len(skipped))
+			start = end
+			if bw.progress != nil {
+				bw.progress(&bw.report)
+			}
+		case failedID != "":
+			skip[failedID] = true
+			bw.fail(failedID, err)
+		case errors.Is(err, badger.ErrTxnTooBig) && len(batch) > 1:
+			bw.batchSize = max(len(batch)/2, 1)
+		case errors.Is(err, badger.ErrConflict) && conflicts < bulkMaxConflicts:
+			conflicts++
+		default:
+			for _, id := range batch {
+				if !skip[id] {
+					bw.fail(id, err)
+				}
+			}
+			start = end
+		}
+	}
+
+	return nil
+}
+
+// matched adds entities matched by update or deleteAll to the total
+func (bw *bulkWriter) matched(count int) {
+	bw.report.Total += int64(count)
+}
+
+func (bw *bulkWriter) fail(id string, err error) {
+	bw.report.Failed++
+	bw.report.Errors = append(bw.report.Errors, BulkError{ID: id, Error: err.Error()})
+}
+
+// writeBatch returns the id that made the batch fail, empty when the failure is the transaction itself,
+// and the ids skipped by the attempt
+func writeBatch(batch []string, skip map[string]bool, fn func(txn *badger.Txn, id string) error) (failed string, skipped map[string]bool, err error) {
+	txn := edb.NewTransaction(true)
+	defer txn.Discard()
+	defer func() { afterCommit(txn, err) }()
+
+	skipped = map[string]bool{}
+	for _, id := range batch {
+		if skip[id] {
+			continue
+		}
+
+		if err := fn(txn, id); err != nil {
+			if errors.Is(err, errBulkSkip) {
+				skipped[id] = true
+				continue
+			}
+
+			if errors.Is(err, badger.ErrTxnTooBig) {
+				return "", nil, err
+			}
+			return id, nil, err
+		}
+	}
+
+	return "", skipped, txn.Commit()
+}
+
+// bulkProgress wraps the progress: option of a bulk function, it receives the report as a hash
+func bulkProgress(env *zygo.Zlisp, options map[string]zygo.Sexp) (func(*BulkReport), error) {
+	option, ok := options["progress"]
+	if !ok {
+		return nil, nil
+	}
+
+	callback, ok := option.(*zygo.SexpFunction)
+	if !ok {
+		return nil, errors.New("progress must be a function")
+	}
+
+	return func(report *BulkReport) {
+		env.Apply(callback, []zygo.Sexp{reportToSexp(env, report)})
+	}, nil
+}
+
+func reportToSexp(env *zygo.Zlisp, report *BulkReport) zygo.Sexp {
+	errs := make([]map[string]string, 0, len(report.Errors))
+	for _, bulkErr := range report.Errors {
+		errs = append(errs, map[string]string{"id": bulkErr.ID, "error": bulkErr.Error})
+	}
+
+	return parser.ToSexp(env, map[string]any{
+		"total":  report.Total,
+		"done":   report.Done,
+		"failed": report.Failed,
+		"errors": errs,
+	})
+}
+
+// chunks split ids in slices of at most size elements
+func chunks(ids []string, size int) [][]string {
+	var result [][]string
+	for start := 0; start < len(ids); start += size {
+		result = append(result, ids[start:min(start+size, len(ids))])
+	}
+
+	return result
+}
@@ -0,0 +1,83 @@
+package storage
+
+import "time"
+
+const (
+	ruleCascade  = "cascade"
+	ruleRestrict = "restrict"
+	ruleUnlink   = "unlink"
+)
+
+const (
+	hooksDir = "hooks"
+
+	hookBeforeInsert = "beforeInsert"
+	hookAfterInsert  = "afterInsert"
+	hookBeforeUpdate = "beforeUpdate"
+	hookAfterUpdate  = "afterUpdate"
+	hookBeforeDelete = "beforeDelete"
+	hookAfterDelete  = "afterDelete"
+)
+
+const (
+	accessDir = "access"
+
+	accessRead   = "read"
+	accessInsert = "insert"
+	accessUpdate = "update"
+	accessDelete = "delete"
+)
+
+const (
+	// entities written per transaction before splitting on badger.ErrTxnTooBig
+	bulkBatchSize = 512
+	// deletes iterate over every key of an entity, smaller batches keep iterators cheap
+	bulkDeleteBatchSize = 64
+	// commit retries of a batch on transaction conflicts
+	bulkMaxConflicts = 3
+)
+
+const (
+	encryptionKeyEnv     = "QOKL_ENCRYPTION_KEY"
+	encryptionKeyFileEnv = "QOKL_ENCRYPTION_KEY_FILE"
+	keyRotationEnv       = "QOKL_DATA_KEY_ROTATION"
+	indexCacheSizeEnv    = "QOKL_INDEX_CACHE_SIZE"
+
+	// default index cache used when encryption is enabled, in bytes
+	defaultIndexCacheSize = 100 << 20
+)
+
+const (
+	// attempts of an atomic operation conflicting with concurrent writes
+	atomicMaxRetries = 32
+)
+
+const (
+	outboxPrefix     = "outbox."
+	outboxDeadPrefix = "outboxdead."
+	// failed relays of an outbox entry before it is parked as a dead letter
+	outboxMaxAttempts = 10
+)
+
+const (
+	// blobs are stored in chunks of this size, in bytes
+	blobChunkSize = 1 << 20
+)
+
+const (
+	// characters of the geohashes stored in the spatial index, about 4cm cells
+	geohashPrecision = 12
+	// cells scanned by a spatial query
+	geoMaxCells = 16
+	// entities returned by near and within without limit:
+	geoDefaultLimit = 100
+)
+
+const (
+	gcIntervalEnv = "QOKL_GC_INTERVAL"
+	gcRatioEnv    = "QOKL_GC_RATIO"
+
+	defaultGCInterval = 10 * time.Minute
+	// files are rewritten when at least this fraction of them is garbage
+	defaultGCRatio = 0.5
+)
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// LoadEncryptionKey reads the master key from QOKL_ENCRYPTION_KEY_FILE or
+// QOKL_ENCRYPTION_KEY, returns nil when encryption is not configured
+func LoadEncryptionKey() ([]byte, error) {
+	if path := os.Getenv(encryptionKeyFileEnv); path != "" {
+		return ReadKeyFile(path)
+	}
+
+	if key := os.Getenv(encryptionKeyEnv); key != "" {
+		return parseKey(key)
+	}
+
+	return nil, nil
+}
+
+// ReadKeyFile reads an encryption key from a file
+func ReadKeyFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file %s: %w", path, err)
+	}
+
+	return parseKey(strings.TrimSpace(string(content)))
+}
+
+// parseKey accepts keys of 16, 24 or 32 bytes (AES-128/192/256) written as
+// "hex:<key>", "base64:<key>" or "raw:<key>", a key without prefix is decoded as
+// hex when possible and taken raw otherwise, unless both readings are valid keys
+func parseKey(key string) ([]byte, error) {
+	var decoded []byte
+	var err error
+
+	switch {
+	case strings.HasPrefix(key, "hex:"):
+		decoded, err = hex.DecodeString(strings.TrimPrefix(key, "hex:"))
+	case strings.HasPrefix(key, "base64:"):
+		decoded, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(key, "base64:"))
+	case strings.HasPrefix(key, "raw:"):
+		decoded = []byte(strings.TrimPrefix(key, "raw:"))
+	default:
+		hexKey, hexErr := hex.DecodeString(key)
+		switch {
+		case hexErr == nil && validKeySize(hexKey) && validKeySize([]byte(key)):
+			return nil, errors.New("encryption key is valid both as hex and raw, prefix it with hex: or raw:")
+		case hexErr == nil && validKeySize(hexKey):
+			decoded = hexKey
+		default:
+			decoded = []byte(key)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	if !validKeySize(decoded) {
+		return nil, errors.New("encryption key must have 16, 24 or 32 bytes")
+	}
+
+	return decoded, nil
+}
+
+// validKeySize checks if a key fits AES-128, AES-192 or AES-256
+func validKeySize(key []byte) bool {
+	switch len(key) {
+	case 16, 24, 32:
+		return true
+	}
+	return false
+}
+
+// WithEncryption applies the configured encryption key and index cache to badger options
+func WithEncryption(opts badger.Options) (badger.Options, error) {
+	if size := os.Getenv(indexCacheSizeEnv); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %w", indexCacheSizeEnv, err)
+		}
+		opts = opts.WithIndexCacheSize(n)
+	}
+
+	key, err := LoadEncryptionKey()
+	if err != nil || key == nil {
+		return opts, err
+	}
+
+	opts = opts.WithEncryptionKey(key)
+	if opts.IndexCacheSize == 0 {
+		opts = opts.WithIndexCacheSize(defaultIndexCacheSize)
+	}
+
+	if rotation := os.Getenv(keyRotationEnv); rotation != "" {
+		d, err := time.ParseDuration(rotation)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %w", keyRotationEnv, err)
+		}
+		opts = opts.WithEncryptionKeyRotationDuration(d)
+	}
+
+	return opts, nil
+}
+
+// RotateKey re-encrypts the key registry of a closed database with a new master key,
+// data keys are kept so existing tables remain readable
+func RotateKey(dir string, oldKey, newKey []byte) error {
+	opt := badger.KeyRegistryOptions{
+		Dir:           dir,
+		ReadOnly:      true,
+		EncryptionKey: oldKey,
+	}
+
+	registry, err := badger.OpenKeyRegistry(opt)
+	if err != nil {
+		return fmt.Errorf("could not open key registry at %s: %w", dir, err)
+	}
+
+	opt.EncryptionKey = newKey
+	return badger.WriteKeyRegistry(registry, opt)
+}
@@ -0,0 +1,378 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+/*
+* # Spatial index
+*
+* (geoIndex store: %lat %lng) // index entities of a tag by two of their components
+* (near store: lat lng radius: 5000 limit: 20) // entities within radius meters, closest first
+* (within store: minLat minLng maxLat maxLng limit: 20) // entities inside a bounding box, closest to its center first
+*
+* results carry their distance to the point (or the box center) in meters as `distance`.
+* Boxes crossing the antimeridian are not supported.
+*
+* geoi.<tag> // indexed components
+* geo.<tag>.<geohash>.<id> // index entry
+* geor.<id>.<tag> // geohash of an entity, to remove its entry when it moves
+ */
+
+// geoConfig components holding the coordinates of a tag
+type geoConfig struct {
+	Lat string `json:"lat"`
+	Lng string `json:"lng"`
+}
+
+// geoMatch an entity found by a spatial query
+type geoMatch struct {
+	id       string
+	distance float64
+}
+
+// FnGeoIndex index the entities of a tag by their coordinates, existing entities are indexed right away
+// Lisp (geoIndex store: %lat %lng)
+func FnGeoIndex(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 3 {
+		return parser.SignalWrongArgs()
+	}
+
+	tag, tagOk := args[0].(*zygo.SexpSymbol)
+	lat, latOk := args[1].(*zygo.SexpSymbol)
+	lng, lngOk := args[2].(*zygo.SexpSymbol)
+	if !tagOk || !latOk || !lngOk {
+		return parser.SignalErr(env, errors.New("geoIndex: tag and components must be symbols"))
+	}
+
+	if err := guardOf(env).allowSchema("geoIndex"); err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	data, err := json.Marshal(geoConfig{Lat: lat.Name(), Lng: lng.Name()})
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	var ids []string
+	err = update(env, func(txn *badger.Txn) error {
+		ids = tagEntityIDs(txn, tag.Name())
+		return txn.Set(makeGeoConfigEntry(tag.Name()), data)
+	})
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	writer := newBulkWriter(env, len(ids), bulkBatchSize, nil)
+	err = writer.write(ids, func(txn *badger.Txn, objID string) error {
+		return indexGeo(txn, objID, []string{tag.Name()})
+	})
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.SignalOk(env)
+}
+
+// FnNear entities of a tag within a radius of a point
+// Lisp (near store: lat lng radius: 5000 limit: 20)
+func FnNear(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 3 {
+		return parser.SignalWrongArgs()
+	}
+
+	tag, tagOk := args[0].(*zygo.SexpSymbol)
+	if !tagOk {
+		return parser.SignalWrongArgs()
+	}
+
+	coords, err := sexpFloats(args[1:3])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	options, err := parser.Options(args[3:])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	radiusOption, ok := options["radius"]
+	if !ok {
+		return parser.SignalErr(env, errors.New("near: radius: is required"))
+	}
+
+	radius, err := sexpFloats([]zygo.Sexp{radiusOption})
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	limit, err := geoLimit(options)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	lat, lng := coords[0], coords[1]
+	return geoQuery(env, tag.Name(), lat, lng, limit, boundingBoxes(lat, lng, radius[0]), func(pointLat, pointLng, distance float64) bool {
+		return distance <= radius[0]
+	})
+}
+
+// FnWithin entities of a tag inside a bounding box
+// Lisp (within store: minLat minLng maxLat maxLng limit: 20)
+func FnWithin(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 5 {
+		return parser.SignalWrongArgs()
+	}
+
+	tag, tagOk := args[0].(*zygo.SexpSymbol)
+	if !tagOk {
+		return parser.SignalWrongArgs()
+	}
+
+	box, err := sexpFloats(args[1:5])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	options, err := parser.Options(args[5:])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	limit, err := geoLimit(options)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	minLat, minLng, maxLat, maxLng := box[0], box[1], box[2], box[3]
+	if minLat > maxLat || minLng > maxLng {
+		return parser.SignalErr(env, errors.New("within: min coordinates must not exceed max coordinates"))
+	}
+
+	centerLat, centerLng := (minLat+maxLat)/2, (minLng+maxLng)/2
+	return geoQuery(env, tag.Name(), centerLat, centerLng, limit, []geoBox{{minLat, minLng, maxLat, maxLng}}, func(pointLat, pointLng, distance float64) bool {
+		return pointLat >= minLat && pointLat <= maxLat && pointLng >= minLng && pointLng <= maxLng
+	})
+}
+
+// geoQuery scans the cells covering boxes, keeping entities accepted by match sorted by distance to a point
+func geoQuery(env *zygo.Zlisp, tag string, lat, lng float64, limit int, boxes []geoBox, match func(pointLat, pointLng, distance float64) bool) (zygo.Sexp, error) {
+	var matches []geoMatch
+	err := view(env, func(txn *badger.Txn) error {
+		config, ok := geoConfigOf(txn, tag)
+		if !ok {
+			return fmt.Errorf("%s has no spatial index, create it with geoIndex", tag)
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		var cells []string
+		for _, box := range boxes {
+			cells = append(cells, geohashCover(box.minLat, box.minLng, box.maxLat, box.maxLng, geoMaxCells/len(boxes))...)
+		}
+
+		for _, cell := range cells {
+			query := makeGeoCellQuery(tag, cell)
+			for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+				key := strings.TrimPrefix(string(it.Item().Key()), string(query))
+				_, objID, found := strings.Cut(key, ".")
+				if !found {
+					continue
+				}
+
+				pointLat, pointLng, ok := entityCoords(txn, objID, config)
+				if !ok {
+					continue
+				}
+
+				distance := haversine(lat, lng, pointLat, pointLng)
+				if match(pointLat, pointLng, distance) {
+					matches = append(matches, geoMatch{id: objID, distance: distance})
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].distance < matches[j].distance
+	})
+
+	rows := &zygo.SexpArray{}
+	for _, match := range matches {
+		if len(rows.Val) >= limit {
+			break
+		}
+
+		entityHash := retrieveEntity(env, match.id)
+		if !canRead(env, match.id, entityHash) {
+			continue
+		}
+
+		entityHash.HashSet(env.MakeSymbol("distance"), &zygo.SexpFloat{Val: match.distance})
+		rows.Val = append(rows.Val, entityHash)
+	}
+
+	return rows, nil
+}
+
+// indexGeo updates the index entries of an entity for the tags with a spatial index
+func indexGeo(txn *badger.Txn, objID string, tags []string) error {
+	for _, tag := range tags {
+		config, ok := geoConfigOf(txn, tag)
+		if !ok {
+			continue
+		}
+
+		if err := unindexGeoTag(txn, objID, tag); err != nil {
+			return err
+		}
+
+		lat, lng, ok := entityCoords(txn, objID, config)
+		if !ok {
+			continue
+		}
+
+		geohash := geohashEncode(lat, lng, geohashPrecision)
+		if err := txn.Set(makeGeoEntry(tag, geohash, objID), []byte("1")); err != nil {
+			return err
+		}
+
+		if err := txn.Set(makeGeoReverseEntry(objID, tag), []byte(geohash)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexGeo removes every index entry of an entity
+func unindexGeo(txn *badger.Txn, objID string) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var tags []string
+	query := makeGeoReverseQuery(objID)
+	for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+		tags = append(tags, strings.TrimPrefix(string(it.Item().Key()), string(query)))
+	}
+
+	for _, tag := range tags {
+		if err := unindexGeoTag(txn, objID, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unindexGeoTag(txn *badger.Txn, objID string, tag string) error {
+	item, err := txn.Get(makeGeoReverseEntry(objID, tag))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	geohash, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Delete(makeGeoEntry(tag, string(geohash), objID)); err != nil {
+		return err
+	}
+
+	return txn.Delete(makeGeoReverseEntry(objID, tag))
+}
+
+func geoConfigOf(txn *badger.Txn, tag string) (geoConfig, bool) {
+	var config geoConfig
+	item, err := txn.Get(makeGeoConfigEntry(tag))
+	if err != nil {
+		return config, false
+	}
+
+	err = item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &config)
+	})
+
+	return config, err == nil
+}
+
+// entityCoords reads the coordinates of an entity, false when they are missing or out of range
+func entityCoords(txn *badger.Txn, objID string, config geoConfig) (float64, float64, bool) {
+	lat, latOk := componentFloat(txn, objID, config.Lat)
+	lng, lngOk := componentFloat(txn, objID, config.Lng)
+	if !latOk || !lngOk || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return 0, 0, false
+	}
+
+	return lat, lng, true
+}
+
+func componentFloat(txn *badger.Txn, objID string, component string) (float64, bool) {
+	item, err := txn.Get(makeEntityComponentEntry(component, objID))
+	if err != nil {
+		return 0, false
+	}
+
+	var stored StoredValue
+	if err := item.Value(func(v []byte) error {
+		return json.Unmarshal(v, &stored)
+	}); err != nil {
+		return 0, false
+	}
+
+	value, ok := stored.Value.(float64)
+	return value, ok
+}
+
+func sexpFloats(args []zygo.Sexp) ([]float64, error) {
+	values := make([]float64, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case *zygo.SexpFloat:
+			values[i] = arg.Val
+		case *zygo.SexpInt:
+			values[i] = float64(arg.Val)
+		default:
+			return nil, fmt.Errorf("expected a number, got %T", arg)
+		}
+	}
+
+	return values, nil
+}
+
+func geoLimit(options map[string]zygo.Sexp) (int, error) {
+	option, ok := options["limit"]
+	if !ok {
+		return geoDefaultLimit, nil
+	}
+
+	limit, ok := option.(*zygo.SexpInt)
+	if !ok || limit.Val <= 0 {
+		return 0, errors.New("limit must be a positive integer")
+	}
+
+	return int(limit.Val), nil
+}
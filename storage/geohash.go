@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"math"
+	"strings"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// earth radius used for distances, in meters
+const earthRadius = 6371000.0
+
+// geohashEncode returns the geohash of a point with precision characters
+func geohashEncode(lat, lng float64, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+
+	var hash strings.Builder
+	bit, ch := 0, 0
+	even := true
+	for hash.Len() < precision {
+		if even {
+			mid := (minLng + maxLng) / 2
+			if lng >= mid {
+				ch |= 1 << (4 - bit)
+				minLng = mid
+			} else {
+				maxLng = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch |= 1 << (4 - bit)
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+		even = !even
+
+		if bit < 4 {
+			bit++
+			continue
+		}
+
+		hash.WriteByte(geohashAlphabet[ch])
+		bit, ch = 0, 0
+	}
+
+	return hash.String()
+}
+
+// geohashCell returns the height and width in degrees of the cells of a precision
+func geohashCell(precision int) (float64, float64) {
+	bits := precision * 5
+	latBits := bits / 2
+	lngBits := bits - latBits
+
+	return 180 / math.Pow(2, float64(latBits)), 360 / math.Pow(2, float64(lngBits))
+}
+
+// geohashCover returns the cells of the largest precision covering a bounding box with at most maxCells cells
+func geohashCover(minLat, minLng, maxLat, maxLng float64, maxCells int) []string {
+	precision := geohashPrecision
+	for ; precision > 1; precision-- {
+		height, width := geohashCell(precision)
+		rows := math.Floor((maxLat-minLat)/height) + 2
+		cols := math.Floor((maxLng-minLng)/width) + 2
+		if rows*cols <= float64(maxCells) {
+			break
+		}
+	}
+
+	height, width := geohashCell(precision)
+	cells := map[string]struct{}{}
+	for lat := minLat; ; lat += height {
+		lat = math.Min(lat, maxLat)
+		for lng := minLng; ; lng += width {
+			lng = math.Min(lng, maxLng)
+			cells[geohashEncode(lat, lng, precision)] = struct{}{}
+			if lng >= maxLng {
+				break
+			}
+		}
+
+		if lat >= maxLat {
+			break
+		}
+	}
+
+	result := make([]string, 0, len(cells))
+	for cell := range cells {
+		result = append(result, cell)
+	}
+
+	return result
+}
+
+// geoBox a bounding box in degrees
+type geoBox struct {
+	minLat, minLng, maxLat, maxLng float64
+}
+
+// boundingBoxes returns the boxes around a point containing every point within radius meters,
+// a box crossing the antimeridian is split in one box on each side of it
+func boundingBoxes(lat, lng, radius float64) []geoBox {
+	dLat := radius / earthRadius * 180 / math.Pi
+	dLng := 180.0
+	if cos := math.Cos(lat * math.Pi / 180); cos > 1e-9 {
+		dLng = math.Min(dLat/cos, 180)
+	}
+
+	minLat, maxLat := math.Max(lat-dLat, -90), math.Min(lat+dLat, 90)
+	minLng, maxLng := lng-dLng, lng+dLng
+	switch {
+	case dLng >= 180:
+		return []geoBox{{minLat, -180, maxLat, 180}}
+	case minLng < -180:
+		return []geoBox{{minLat, minLng + 360, maxLat, 180}, {minLat, -180, maxLat, maxLng}}
+	case maxLng > 180:
+		return []geoBox{{minLat, minLng, maxLat, 180}, {minLat, -180, maxLat, maxLng - 360}}
+	}
+
+	return []geoBox{{minLat, minLng, maxLat, maxLng}}
+}
+
+// haversine returns the distance between two points, in meters
+func haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLng := (lng2 - lng1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
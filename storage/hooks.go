@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+/*
+* # Hooks
+*
+* hooks/<tag>/<event>.lisp runs whenever an entity with <tag> is written, events are
+* beforeInsert, afterInsert, beforeUpdate, afterUpdate, beforeDelete and afterDelete.
+*
+* hooks run inside the write transaction with the entity bound to `e`, entity
+* functions called from a hook join that transaction. A before hook may return
+* false to veto the write or a hash replacing the entity being written.
+ */
+
+var (
+	hooksPath  string
+	newHookEnv func() *zygo.Zlisp
+)
+
+// SetHookEnv sets the factory of environments hooks run in
+func SetHookEnv(factory func() *zygo.Zlisp) {
+	newHookEnv = factory
+}
+
+// runHooks runs an event hook of every tag, before hooks may modify the entity
+func runHooks(txn *badger.Txn, event string, tags []string, obj map[string]any) (map[string]any, error) {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+
+	var err error
+	for _, tag := range sorted {
+		obj, err = runHook(txn, tag, event, obj)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return obj, nil
+}
+
+func runHook(txn *badger.Txn, tag string, event string, obj map[string]any) (map[string]any, error) {
+	if hooksPath == "" || newHookEnv == nil {
+		return obj, nil
+	}
+
+	path := filepath.Join(hooksPath, tag, event+".lisp")
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return obj, nil
+	}
+
+	env := newHookEnv()
+	defer bindTxn(env, txn)()
+
+	env.AddGlobal("e", parser.ToSexp(env, obj))
+	env.AddGlobal("event", parser.ToSexp(env, event))
+	env.AddGlobal("tag", parser.ToSexp(env, tag))
+
+	if err := env.LoadString(string(code)); err != nil {
+		return nil, fmt.Errorf("error executing %s: %w", path, err)
+	}
+
+	out, err := env.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s hook of %s failed: %w", event, tag, err)
+	}
+
+	if !strings.HasPrefix(event, "before") {
+		return obj, nil
+	}
+
+	switch out := out.(type) {
+	case *zygo.SexpBool:
+		if !out.Val {
+			return nil, fmt.Errorf("%s hook of %s vetoed the write", event, tag)
+		}
+	case *zygo.SexpHash:
+		modified := hashToGo(out)
+		modified["id"] = obj["id"]
+		return modified, nil
+	}
+
+	return obj, nil
+}
+
+// entityTags list the tags of an entity
+func entityTags(txn *badger.Txn, objID string) []string {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var tags []string
+	query := makeTagEntryReverseEntity(objID)
+	for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+		tags = append(tags, strings.Replace(string(it.Item().Key()), string(query), "", int(1)))
+	}
+
+	return tags
+}
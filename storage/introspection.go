@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+// StorageStats sizes reported by badger in bytes and value log GC stats
+type StorageStats struct {
+	LSMSize  int64   `json:"lsmSize"`
+	VLogSize int64   `json:"vlogSize"`
+	GC       GCStats `json:"gc"`
+}
+
+// FnTags list every tag in use
+// Lisp (tags)
+func FnTags(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 0 {
+		return parser.SignalWrongArgs()
+	}
+
+	return parser.ToSexp(env, Tags()), nil
+}
+
+// FnCountTag count entities with a tag
+// Lisp (countTag user:)
+func FnCountTag(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 1 {
+		return parser.SignalWrongArgs()
+	}
+
+	tag, tagOk := args[0].(*zygo.SexpSymbol)
+	if !tagOk {
+		return parser.SignalWrongArgs()
+	}
+
+	if guardOf(env) == nil {
+		return &zygo.SexpInt{Val: CountTag(tag.Name())}, nil
+	}
+
+	return &zygo.SexpInt{Val: int64(len(readableIDs(env, tag.Name())))}, nil
+}
+
+// FnComponentsOf list component names used by entities with a tag
+// Lisp (componentsOf user:)
+func FnComponentsOf(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 1 {
+		return parser.SignalWrongArgs()
+	}
+
+	tag, tagOk := args[0].(*zygo.SexpSymbol)
+	if !tagOk {
+		return parser.SignalWrongArgs()
+	}
+
+	if guardOf(env) == nil {
+		return parser.ToSexp(env, ComponentsOf(tag.Name())), nil
+	}
+
+	return parser.ToSexp(env, componentsOf(readableIDs(env, tag.Name()))), nil
+}
+
+// FnRelationshipTypes list every relationship name in use
+// Lisp (relationshipTypes)
+func FnRelationshipTypes(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 0 {
+		return parser.SignalWrongArgs()
+	}
+
+	return parser.ToSexp(env, RelationshipTypes()), nil
+}
+
+// FnStorageStats return badger LSM and value log sizes and value log GC stats
+// Lisp (storageStats)
+func FnStorageStats(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 0 {
+		return parser.SignalWrongArgs()
+	}
+
+	stats := Stats()
+	return parser.ToSexp(env, map[string]int64{
+		"lsmSize":     stats.LSMSize,
+		"vlogSize":    stats.VLogSize,
+		"gcRuns":      stats.GC.Runs,
+		"gcReclaimed": stats.GC.Reclaimed,
+	}), nil
+}
+
+// Tags list every tag in use
+func Tags() []string {
+	var tags []string
+	edb.View(func(txn *badger.Txn) error {
+		tags = distinctSegments(txn, "tags.")
+		return nil
+	})
+
+	return tags
+}
+
+// CountTag count existing entities with a tag
+func CountTag(tagName string) int64 {
+	count := int64(0)
+	edb.View(func(txn *badger.Txn) error {
+		for _, objID := range tagEntityIDs(txn, tagName) {
+			if entityExists(txn, objID) {
+				count++
+			}
+		}
+		return nil
+	})
+
+	return count
+}
+
+// ComponentsOf list sorted component names used by entities with a tag
+func ComponentsOf(tagName string) []string {
+	var ids []string
+	edb.View(func(txn *badger.Txn) error {
+		ids = tagEntityIDs(txn, tagName)
+		return nil
+	})
+
+	return componentsOf(ids)
+}
+
+// componentsOf list sorted component names used by entities
+func componentsOf(ids []string) []string {
+	components := map[string]struct{}{}
+	edb.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for _, objID := range ids {
+			query := makeEntityComponentQuery(objID)
+			for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+				key := strings.Replace(string(it.Item().Key()), string(query), "", int(1))
+				components[key] = struct{}{}
+			}
+		}
+		return nil
+	})
+
+	names := make([]string, 0, len(components))
+	for component := range components {
+		names = append(names, component)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// RelationshipTypes list every relationship name in use
+func RelationshipTypes() []string {
+	var rels []string
+	edb.View(func(txn *badger.Txn) error {
+		rels = distinctSegments(txn, "relationships.")
+		return nil
+	})
+
+	return rels
+}
+
+// Stats return badger LSM and value log sizes and the GC done since the database was opened
+func Stats() StorageStats {
+	lsm, vlog := edb.Size()
+	return StorageStats{LSMSize: lsm, VLogSize: vlog, GC: maintenance.Stats()}
+}
+
+// readableIDs list ids of existing entities tagged with tagName the principal bound to env may read
+func readableIDs(env *zygo.Zlisp, tagName string) []string {
+	var ids []string
+	edb.View(func(txn *badger.Txn) error {
+		for _, objID := range tagEntityIDs(txn, tagName) {
+			if entityExists(txn, objID) {
+				ids = append(ids, objID)
+			}
+		}
+		return nil
+	})
+
+	readable := []string{}
+	for _, objID := range ids {
+		if canRead(env, objID, retrieveEntity(env, objID)) {
+			readable = append(readable, objID)
+		}
+	}
+
+	return readable
+}
+
+// tagEntityIDs list ids of entities tagged with tagName
+func tagEntityIDs(txn *badger.Txn, tagName string) []string {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var ids []string
+	query := makeTagQuery(tagName)
+	for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+		ids = append(ids, strings.Replace(string(it.Item().Key()), string(query), "", int(1)))
+	}
+
+	return ids
+}
+
+// distinctSegments list the distinct key segments right after prefix,
+// skipping the remaining keys of a segment once it is found
+func distinctSegments(txn *badger.Txn, prefix string) []string {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	segments := []string{}
+	for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); {
+		rest := strings.TrimPrefix(string(it.Item().Key()), prefix)
+		segment, _, found := strings.Cut(rest, ".")
+		if !found {
+			it.Next()
+			continue
+		}
+
+		segments = append(segments, segment)
+
+		// "/" is the byte right after ".", seeking it skips the whole segment
+		it.Seek([]byte(prefix + segment + "/"))
+	}
+
+	return segments
+}
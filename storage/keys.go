@@ -1,5 +1,7 @@
 package storage
 
+import "fmt"
+
 // query/storage patterns
 func makeEntityEntry(entityID string) []byte {
 	return []byte("entities." + entityID)
@@ -21,6 +23,10 @@ func makeRelationshipMetaEntry(rel string, e1 string, e2 string) []byte {
 	return []byte("relationshipsm." + rel + "." + e1 + "." + e2)
 }
 
+func makeRelationshipRuleEntry(rel string, relType string) []byte {
+	return []byte("relationshipsr." + rel + "." + relType)
+}
+
 func makeRelationshipEntryOneSide(rel string, e1 string) []byte {
 	return []byte("relationships." + rel + "." + e1 + ".")
 }
@@ -48,3 +54,31 @@ func makeEntityComponentQuery(entityID string) []byte {
 func makeTagQuery(tagName string) []byte {
 	return []byte("tags." + tagName + ".")
 }
+
+func makeBlobEntry(blobID string) []byte {
+	return []byte("blobs." + blobID)
+}
+
+func makeBlobChunkEntry(blobID string, chunk int) []byte {
+	return []byte(fmt.Sprintf("blobc.%s.%08d", blobID, chunk))
+}
+
+func makeGeoConfigEntry(tagName string) []byte {
+	return []byte("geoi." + tagName)
+}
+
+func makeGeoEntry(tagName string, geohash string, entityID string) []byte {
+	return []byte("geo." + tagName + "." + geohash + "." + entityID)
+}
+
+func makeGeoCellQuery(tagName string, cell string) []byte {
+	return []byte("geo." + tagName + "." + cell)
+}
+
+func makeGeoReverseEntry(entityID string, tagName string) []byte {
+	return []byte("geor." + entityID + "." + tagName)
+}
+
+func makeGeoReverseQuery(entityID string) []byte {
+	return []byte("geor." + entityID + ".")
+}
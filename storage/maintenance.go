@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// GCStats value log garbage collection done since the database was opened
+type GCStats struct {
+	Runs      int64     `json:"runs"`
+	Rewrites  int64     `json:"rewrites"`
+	Reclaimed int64     `json:"reclaimed"`
+	LastRun   time.Time `json:"lastRun"`
+}
+
+// Maintenance runs value log GC of a database in the background,
+// every QOKL_GC_INTERVAL rewriting files with at least QOKL_GC_RATIO of garbage
+type Maintenance struct {
+	db       *badger.DB
+	ratio    float64
+	interval time.Duration
+
+	mu    sync.Mutex
+	stats GCStats
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+var maintenance *Maintenance
+
+// NewMaintenance configures the maintenance of db from the environment
+func NewMaintenance(db *badger.DB) (*Maintenance, error) {
+	ratio, err := gcRatio()
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := gcInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Maintenance{db: db, ratio: ratio, interval: interval}, nil
+}
+
+// Start runs GC every interval until Stop, in-memory databases have no value log to collect
+func (m *Maintenance) Start() {
+	if m.interval <= 0 || m.db.Opts().InMemory {
+		return
+	}
+
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := m.RunGC(); err != nil {
+					log.Printf("value log GC failed: %v", err)
+				}
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for a running GC to finish, it must be called before closing the database
+func (m *Maintenance) Stop() {
+	if m.stop == nil {
+		return
+	}
+
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
+
+// RunGC rewrites value log files until none has enough garbage, returns the bytes reclaimed
+func (m *Maintenance) RunGC() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	before := m.vlogSize()
+	rewrites := int64(0)
+
+	var err error
+	for {
+		if err = m.db.RunValueLogGC(m.ratio); err != nil {
+			break
+		}
+		rewrites++
+	}
+
+	reclaimed := max(before-m.vlogSize(), 0)
+	m.stats.Runs++
+	m.stats.Rewrites += rewrites
+	m.stats.Reclaimed += reclaimed
+	m.stats.LastRun = time.Now()
+
+	if errors.Is(err, badger.ErrNoRewrite) || errors.Is(err, badger.ErrRejected) {
+		err = nil
+	}
+
+	return reclaimed, err
+}
+
+// Compact flattens the LSM tree into a single level then runs value log GC
+func (m *Maintenance) Compact() (int64, error) {
+	if err := m.db.Flatten(runtime.NumCPU()); err != nil {
+		return 0, err
+	}
+
+	return m.RunGC()
+}
+
+// Stats returns the GC done so far
+func (m *Maintenance) Stats() GCStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// vlogSize sums the value log files on disk, badger's own sizes are refreshed once a minute
+func (m *Maintenance) vlogSize() int64 {
+	files, _ := filepath.Glob(filepath.Join(m.db.Opts().ValueDir, "*.vlog"))
+
+	size := int64(0)
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+// Compact compacts the database in dir, the database must be closed
+func Compact(dir string) (int64, error) {
+	opts, err := WithEncryption(badger.DefaultOptions(dir))
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	m, err := NewMaintenance(db)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.Compact()
+}
+
+func gcRatio() (float64, error) {
+	value := os.Getenv(gcRatioEnv)
+	if value == "" {
+		return defaultGCRatio, nil
+	}
+
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio <= 0 || ratio >= 1 {
+		return 0, errors.New(gcRatioEnv + " must be a number between 0 and 1")
+	}
+
+	return ratio, nil
+}
+
+func gcInterval() (time.Duration, error) {
+	value := os.Getenv(gcIntervalEnv)
+	if value == "" {
+		return defaultGCInterval, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New(gcIntervalEnv + " must be a duration like 10m, 0 disables it")
+	}
+
+	return interval, nil
+}
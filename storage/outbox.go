@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/parser"
+)
+
+/*
+* # Outbox
+*
+* (transaction (fn [] (insert order: total: 10) (dispatch emails: (msgpack (hash to: "me")))))
+*
+* entities and queues live in different databases, so a dispatch made inside an entity
+* transaction (a hook or a transaction block) is written to the outbox with the entity
+* writes instead. Once the transaction commits the outbox is relayed to the queues, a
+* transaction that fails dispatches nothing. Entries left by a crash are relayed when
+* the databases are opened again, queues skip the ones they already have. An entry that
+* keeps failing does not hold back the ones after it, after outboxMaxAttempts relays it
+* is parked with the outbox dead letters and logged.
+ */
+
+// OutboxEntry a message waiting to be relayed to a queue
+type OutboxEntry struct {
+	ID       string    `json:"id"`
+	Queue    string    `json:"queue"`
+	Msg      []byte    `json:"msg"`
+	Priority int       `json:"priority"`
+	ReadyAt  time.Time `json:"readyAt,omitzero"`
+	// failed relays of the entry
+	Attempts int `json:"attempts,omitempty"`
+}
+
+var (
+	outboxRelay func()
+	// held while relaying so the database is not closed under it
+	relayMu sync.Mutex
+
+	// transactions that wrote to the outbox, relayed once they commit
+	outboxTxns   = make(map[*badger.Txn]bool)
+	outboxTxnsMu sync.Mutex
+)
+
+// SetOutboxRelay sets the function relaying the outbox to the queues
+func SetOutboxRelay(relay func()) {
+	outboxRelay = relay
+}
+
+// InTransaction tells if storage functions called from env join an entity transaction
+func InTransaction(env *zygo.Zlisp) bool {
+	return txnOf(env) != nil
+}
+
+// AddToOutbox writes entry in the transaction bound to env
+func AddToOutbox(env *zygo.Zlisp, entry OutboxEntry) error {
+	txn := txnOf(env)
+	if txn == nil {
+		return errors.New("outbox: no transaction")
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s%020d.%s", outboxPrefix, time.Now().UnixNano(), entry.ID)
+	if err := txn.Set([]byte(key), data); err != nil {
+		return err
+	}
+
+	outboxTxnsMu.Lock()
+	defer outboxTxnsMu.Unlock()
+	outboxTxns[txn] = true
+	return nil
+}
+
+// RelayOutbox passes committed entries to deliver in order, removing the delivered ones.
+// Returns how many were delivered and the first failure, a failed entry is tried again
+// by the next relay until it runs out of attempts and becomes an outbox dead letter.
+func RelayOutbox(deliver func(entry OutboxEntry) error) (int, error) {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	if edb == nil || edb.IsClosed() {
+		return 0, nil
+	}
+
+	keys, entries, err := readOutbox(outboxPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	var firstErr error
+	for i, entry := range entries {
+		if err := deliver(entry); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if err := failOutbox(keys[i], entry, err); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+
+		// the queue skips entries it already has if the delete is lost
+		if err := edb.Update(func(txn *badger.Txn) error { return txn.Delete(keys[i]) }); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+
+	return delivered, firstErr
+}
+
+// OutboxDeadLetters returns the entries that ran out of relay attempts
+func OutboxDeadLetters() ([]OutboxEntry, error) {
+	_, entries, err := readOutbox(outboxDeadPrefix)
+	return entries, err
+}
+
+// readOutbox reads the entries under prefix in order
+func readOutbox(prefix string) ([][]byte, []OutboxEntry, error) {
+	var keys [][]byte
+	var entries []OutboxEntry
+	err := edb.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			var entry OutboxEntry
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &entry)
+			})
+			if err != nil {
+				return err
+			}
+
+			keys = append(keys, it.Item().KeyCopy(nil))
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+
+	return keys, entries, err
+}
+
+// failOutbox counts a failed relay of the entry at key, parking it once it runs out of attempts
+func failOutbox(key []byte, entry OutboxEntry, cause error) error {
+	entry.Attempts++
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if entry.Attempts < outboxMaxAttempts {
+		return edb.Update(func(txn *badger.Txn) error { return txn.Set(key, data) })
+	}
+
+	log.Printf("outbox entry %s for %s failed %d times, parked as a dead letter: %v",
+		entry.ID, entry.Queue, entry.Attempts, cause)
+
+	deadKey := append([]byte(outboxDeadPrefix), key[len(outboxPrefix):]...)
+	return edb.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(deadKey, data); err != nil {
+			return err
+		}
+		return txn.Delete(key)
+	})
+}
+
+// relayOutbox relays the outbox in the background if one is set
+func relayOutbox() {
+	if outboxRelay != nil {
+		go outboxRelay()
+	}
+}
+
+// commit runs fn in a new read-write transaction, relaying what it wrote to the outbox once it commits
+func commit(fn func(txn *badger.Txn) error) error {
+	var current *badger.Txn
+	err := edb.Update(func(txn *badger.Txn) error {
+		current = txn
+		return fn(txn)
+	})
+
+	afterCommit(current, err)
+	return err
+}
+
+// afterCommit relays the outbox if txn wrote to it and committed
+func afterCommit(txn *badger.Txn, err error) {
+	outboxTxnsMu.Lock()
+	wrote := outboxTxns[txn]
+	delete(outboxTxns, txn)
+	outboxTxnsMu.Unlock()
+
+	if wrote && err == nil {
+		relayOutbox()
+	}
+}
+
+// FnTransaction runs a function in one entity transaction, committed when it returns
+// and discarded when it fails. Dispatches made inside go through the outbox.
+// Lisp (transaction (fn [] (insert order: total: 10) (dispatch emails: msg)))
+func FnTransaction(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 1 {
+		return parser.SignalWrongArgs()
+	}
+
+	fn, ok := args[0].(*zygo.SexpFunction)
+	if !ok {
+		return zygo.SexpNull, errors.New("transaction: arg must be a function")
+	}
+
+	// nested transactions join the outer one
+	if txnOf(env) != nil {
+		return env.Apply(fn, []zygo.Sexp{})
+	}
+
+	var result zygo.Sexp = zygo.SexpNull
+	err := commit(func(txn *badger.Txn) error {
+		defer bindTxn(env, txn)()
+
+		var err error
+		result, err = env.Apply(fn, []zygo.Sexp{})
+		return err
+	})
+	if err != nil {
+		return zygo.SexpNull, fmt.Errorf("transaction: %w", err)
+	}
+
+	return result, nil
+}
@@ -19,6 +19,9 @@ func FnEntityGet(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, err
 
 	objID := getEntityIDFromQuery(args[0])
 	entityHash := retrieveEntity(env, objID)
+	if !canRead(env, objID, entityHash) {
+		return &zygo.SexpHash{Map: make(map[int][]*zygo.SexpPair)}, nil
+	}
 
 	return entityHash, nil
 }
@@ -73,7 +76,7 @@ func retrieveEntity(env *zygo.Zlisp, objID string) *zygo.SexpHash {
 	}
 
 	keysFound := 0
-	edb.View(func(txn *badger.Txn) error {
+	view(env, func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		query := makeEntityComponentQuery(objID)
@@ -103,3 +106,25 @@ func retrieveEntity(env *zygo.Zlisp, objID string) *zygo.SexpHash {
 
 	return &entityHash
 }
+
+// readEntity read components of an entity, id included
+func readEntity(txn *badger.Txn, objID string) map[string]any {
+	obj := map[string]any{"id": objID}
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	query := makeEntityComponentQuery(objID)
+	for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+		item := it.Item()
+		key := strings.Replace(string(item.Key()), string(query), "", int(1))
+		item.Value(func(v []byte) error {
+			var itemValue StoredValue
+			if err := json.Unmarshal(v, &itemValue); err == nil {
+				obj[key] = itemValue.Value
+			}
+			return nil
+		})
+	}
+
+	return obj
+}
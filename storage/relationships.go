@@ -11,7 +11,8 @@ import (
 	"github.com/seapvnk/qokl/parser"
 )
 
-// FnEntityRelationships fetch every which meet criterea
+// FnEntityRelationships fetch every which meet criterea, relationships of entities the
+// bound principal can't read are skipped
 // Lisp (relationshipsOf myEntity are: %friends)
 func FnEntityRelationships(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
 	if len(args) != 3 {
@@ -30,8 +31,12 @@ func FnEntityRelationships(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo
 	}
 
 	rows := &zygo.SexpArray{}
+	guarded := guardOf(env) != nil
+	if guarded && !canRead(env, objID, retrieveEntity(env, objID)) {
+		return rows, nil
+	}
 
-	edb.View(func(txn *badger.Txn) error {
+	view(env, func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		query := makeRelationshipEntryOneSide(rel.Name(), objID)
@@ -44,7 +49,7 @@ func FnEntityRelationships(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo
 				return nil
 			})
 
-			if skip {
+			if skip || guarded && !canRead(env, key, retrieveEntity(env, key)) {
 				continue
 			}
 
@@ -114,7 +119,18 @@ func FnRelationship(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp,
 		relData = args[4]
 	}
 
-	err := edb.Update(func(txn *badger.Txn) error {
+	g := guardOf(env)
+	err := update(env, func(txn *badger.Txn) error {
+		for _, objID := range entities {
+			if !entityExists(txn, objID) {
+				return fmt.Errorf("entity %s does not exist", objID)
+			}
+
+			if err := allowUpdate(txn, g, objID, nil); err != nil {
+				return err
+			}
+		}
+
 		return addRelationship(txn, entities, relType, rel, relData)
 	})
 
@@ -193,3 +209,70 @@ func addRelationship(txn *badger.Txn, entityIDs []string, relType string, rel st
 
 	return nil
 }
+
+// FnOnDelete declare what happens to related entities when an entity is deleted,
+// cascade deletes them, restrict blocks the deletion and unlink (default) only removes the relationship
+// Lisp (onDelete has: %orders %cascade)
+func FnOnDelete(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 3 {
+		return parser.SignalWrongArgs()
+	}
+
+	relType, relTypeOk := args[0].(*zygo.SexpSymbol)
+	if !relTypeOk {
+		return parser.SignalErr(env, errors.New("relation type must be a symbol"))
+	}
+
+	rel, relOk := args[1].(*zygo.SexpSymbol)
+	if !relOk {
+		return parser.SignalErr(env, errors.New("rel must be a symbol"))
+	}
+
+	action, actionOk := args[2].(*zygo.SexpSymbol)
+	if !actionOk {
+		return parser.SignalErr(env, errors.New("action must be a symbol"))
+	}
+
+	switch relType.Name() {
+	case "has", "belongs", "are":
+	default:
+		return parser.SignalErr(env, fmt.Errorf("undefined relationship type: %s", relType.Name()))
+	}
+
+	if err := guardOf(env).allowSchema("onDelete"); err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	err := update(env, func(txn *badger.Txn) error {
+		key := makeRelationshipRuleEntry(rel.Name(), relType.Name())
+		switch action.Name() {
+		case ruleCascade, ruleRestrict:
+			return txn.Set(key, []byte(action.Name()))
+		case ruleUnlink:
+			return txn.Delete(key)
+		default:
+			return fmt.Errorf("undefined delete rule: %s", action.Name())
+		}
+	})
+
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return parser.SignalOk(env)
+}
+
+// relationshipRule delete rule for entities on the other side of a relType edge
+func relationshipRule(txn *badger.Txn, rel string, relType string) string {
+	item, err := txn.Get(makeRelationshipRuleEntry(rel, relType))
+	if err != nil {
+		return ruleUnlink
+	}
+
+	rule, err := item.ValueCopy(nil)
+	if err != nil {
+		return ruleUnlink
+	}
+
+	return string(rule)
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"fmt"
 	"strings"
 
 	badger "github.com/dgraph-io/badger/v4"
@@ -8,10 +9,11 @@ import (
 	"github.com/seapvnk/qokl/parser"
 )
 
-// FnEntityDeleteAll return all entities that matches
-// Lisp (deleteAll admin: (Fn [e] (and (> (hget %age) 22) (= (hget name) "Pedro"))))
+// FnEntityDeleteAll delete all entities that matches, deletions are committed in batches.
+// Returns the report, entities already deleted by the cascade of another are not counted.
+// Lisp (deleteAll admin: (Fn [e] (and (> (hget %age) 22) (= (hget name) "Pedro"))) progress: (fn [report] ...))
 func FnEntityDeleteAll(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return parser.SignalWrongArgs()
 	}
 
@@ -25,43 +27,55 @@ func FnEntityDeleteAll(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sex
 		return parser.SignalWrongArgs()
 	}
 
-	count := int64(0)
-	edb.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		query := makeTagQuery(tag.Name())
-		for it.Seek(query); it.ValidForPrefix(query); it.Next() {
-			item := it.Item()
-			key := strings.Replace(string(item.Key()), string(query), "", int(1))
-			err := deleteRowInQuery(env, key, predicate)
-			if err == nil {
-				count++
-			}
-		}
+	options, err := parser.Options(args[2:])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	progress, err := bulkProgress(env, options)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	var ids []string
+	view(env, func(txn *badger.Txn) error {
+		ids = tagEntityIDs(txn, tag.Name())
 		return nil
 	})
 
-	return &zygo.SexpInt{Val: count}, nil
-}
-
-func deleteRowInQuery(env *zygo.Zlisp, key string, predicate *zygo.SexpFunction) error {
-	entityHash := retrieveEntity(env, key)
-	result, err := env.Apply(predicate, []zygo.Sexp{entityHash})
-	if err == nil {
-		result, isBool := result.(*zygo.SexpBool)
-		if !isBool {
-			return nil
+	g := guardOf(env)
+	writer := newBulkWriter(env, 0, bulkDeleteBatchSize, progress)
+	for _, chunk := range chunks(ids, bulkBatchSize) {
+		var matched []string
+		for _, key := range chunk {
+			if rowMatches(env, key, predicate) {
+				matched = append(matched, key)
+			}
 		}
 
-		if result.Val {
-			return deleteEntity(key)
+		writer.matched(len(matched))
+		err := writer.write(matched, func(txn *badger.Txn, key string) error {
+			if !entityExists(txn, key) {
+				return errBulkSkip
+			}
+
+			return deleteEntityTxn(txn, key, g)
+		})
+
+		if err != nil {
+			return parser.SignalErr(env, err)
 		}
 	}
 
-	return nil
+	return reportToSexp(env, &writer.report), nil
+}
+
+func rowMatches(env *zygo.Zlisp, key string, predicate *zygo.SexpFunction) bool {
+	entityHash := retrieveEntity(env, key)
+	return canRead(env, key, entityHash) && entityMatches(env, entityHash, predicate)
 }
 
-// FnRelationship add tag to an entity
+// FnDeleteEntity delete an entity
 // Lisp (deleteEntity myEntity)
 func FnDeleteEntity(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
 	if len(args) != 1 {
@@ -69,7 +83,9 @@ func FnDeleteEntity(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp,
 	}
 
 	objID := getEntityIDFromQuery(args[0])
-	err := deleteEntity(objID)
+	err := update(env, func(txn *badger.Txn) error {
+		return deleteEntityTxn(txn, objID, guardOf(env))
+	})
 
 	if err != nil {
 		return parser.SignalErr(env, err)
@@ -78,16 +94,109 @@ func FnDeleteEntity(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp,
 	return parser.SignalOk(env)
 }
 
-func deleteEntity(objID string) error {
-	err := edb.Update(func(txn *badger.Txn) error {
-		err := removeAllTags(txn, objID)
-		err = removeAllRelationships(txn, objID)
-		err = removeEntityFields(txn, objID)
-		err = txn.Delete(makeEntityEntry(objID))
+// deleteEntityTxn delete an entity and its cascade dependents running their delete hooks,
+// every one of them must be allowed by g
+func deleteEntityTxn(txn *badger.Txn, objID string, g *guard) error {
+	objIDs, err := collectCascade(txn, objID, map[string]bool{})
+	if err != nil {
 		return err
-	})
+	}
+
+	for _, id := range objIDs {
+		tags := entityTags(txn, id)
+		obj := readEntity(txn, id)
+		if err := g.allow(accessDelete, tags, obj); err != nil {
+			return err
+		}
+
+		obj, err := runHooks(txn, hookBeforeDelete, tags, obj)
+		if err != nil {
+			return err
+		}
+
+		if err := removeEntity(txn, id); err != nil {
+			return err
+		}
+
+		if _, err := runHooks(txn, hookAfterDelete, tags, obj); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-	return err
+func removeEntity(txn *badger.Txn, objID string) error {
+	if err := unindexGeo(txn, objID); err != nil {
+		return err
+	}
+
+	if err := removeAllTags(txn, objID); err != nil {
+		return err
+	}
+
+	if err := removeAllRelationships(txn, objID); err != nil {
+		return err
+	}
+
+	if err := removeEntityFields(txn, objID); err != nil {
+		return err
+	}
+
+	return txn.Delete(makeEntityEntry(objID))
+}
+
+// collectCascade list the entity and every entity that must be deleted with it,
+// fails if a restrict rule finds dependents
+func collectCascade(txn *badger.Txn, objID string, visited map[string]bool) ([]string, error) {
+	if visited[objID] {
+		return nil, nil
+	}
+	visited[objID] = true
+	objIDs := []string{objID}
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	query := makeRelationshipTagQuery(objID)
+	for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+		rel := strings.Replace(string(it.Item().Key()), string(query), "", int(1))
+		dependents, err := collectRelationshipCascade(txn, rel, objID, visited)
+		if err != nil {
+			return nil, err
+		}
+		objIDs = append(objIDs, dependents...)
+	}
+
+	return objIDs, nil
+}
+
+func collectRelationshipCascade(txn *badger.Txn, rel string, objID string, visited map[string]bool) ([]string, error) {
+	var objIDs []string
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	query := makeRelationshipEntryOneSide(rel, objID)
+	for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+		item := it.Item()
+		targetID := strings.Replace(string(item.Key()), string(query), "", int(1))
+		relType, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		switch relationshipRule(txn, rel, string(relType)) {
+		case ruleRestrict:
+			return nil, fmt.Errorf("cannot delete %s: it %s %s entities", objID, relType, rel)
+		case ruleCascade:
+			dependents, err := collectCascade(txn, targetID, visited)
+			if err != nil {
+				return nil, err
+			}
+			objIDs = append(objIDs, dependents...)
+		}
+	}
+
+	return objIDs, nil
 }
 
 func removeEntityFields(txn *badger.Txn, objID string) error {
@@ -116,6 +225,10 @@ func removeAllRelationships(txn *badger.Txn, objID string) error {
 		if err != nil {
 			return err
 		}
+
+		if err := txn.Delete(item.KeyCopy(nil)); err != nil {
+			return err
+		}
 	}
 
 	return nil
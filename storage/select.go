@@ -26,7 +26,7 @@ func FnEntitySelect(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp,
 	}
 
 	rows := &zygo.SexpArray{}
-	edb.View(func(txn *badger.Txn) error {
+	view(env, func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		query := makeTagQuery(tag.Name())
@@ -43,6 +43,10 @@ func FnEntitySelect(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp,
 
 func appendQueryToRow(env *zygo.Zlisp, rows *zygo.SexpArray, key string, predicate *zygo.SexpFunction) {
 	entityHash := retrieveEntity(env, key)
+	if !canRead(env, key, entityHash) {
+		return
+	}
+
 	result, err := env.Apply(predicate, []zygo.Sexp{entityHash})
 	if err == nil {
 		result, isBool := result.(*zygo.SexpBool)
@@ -55,3 +59,65 @@ func appendQueryToRow(env *zygo.Zlisp, rows *zygo.SexpArray, key string, predica
 		}
 	}
 }
+
+// FnEntityEach call a function for every entity that matches without building the result in memory,
+// returns how many entities were visited
+// Lisp (each admin: (fn [e] (> (hget e %age) 22)) (fn [e] (emit e)))
+func FnEntityEach(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) != 3 {
+		return parser.SignalWrongArgs()
+	}
+
+	tag, tagOk := args[0].(*zygo.SexpSymbol)
+	if !tagOk {
+		return parser.SignalWrongArgs()
+	}
+
+	predicate, predicateOk := args[1].(*zygo.SexpFunction)
+	if !predicateOk {
+		return parser.SignalWrongArgs()
+	}
+
+	callback, callbackOk := args[2].(*zygo.SexpFunction)
+	if !callbackOk {
+		return parser.SignalWrongArgs()
+	}
+
+	count := int64(0)
+	err := view(env, func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		query := makeTagQuery(tag.Name())
+		for it.Seek(query); it.ValidForPrefix(query); it.Next() {
+			key := strings.Replace(string(it.Item().Key()), string(query), "", int(1))
+			entityHash := retrieveEntity(env, key)
+			if !canRead(env, key, entityHash) || !entityMatches(env, entityHash, predicate) {
+				continue
+			}
+
+			if _, err := env.Apply(callback, []zygo.Sexp{entityHash}); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	return &zygo.SexpInt{Val: count}, nil
+}
+
+func entityMatches(env *zygo.Zlisp, entityHash *zygo.SexpHash, predicate *zygo.SexpFunction) bool {
+	result, err := env.Apply(predicate, []zygo.Sexp{entityHash})
+	if err != nil {
+		return false
+	}
+
+	match, isBool := result.(*zygo.SexpBool)
+	return isBool && match.Val
+}
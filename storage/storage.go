@@ -18,13 +18,20 @@ import (
 *
 * ## entity api:
 * (insert %(admin user) name: "Pedro" age: 23)
+* (insertMany %(admin user) [(hash name: "Pedro") (hash name: "Sergio")] progress: (fn [report] ...)) // batched bulk load
 * (tag admin: myEntity) // can be entity id or entity hash (with id key inside)
 * (entity myEntity) // get entity by id
 * (remove myEntity) // delete entity by id
 * (relationship myEntity yourEntity are: %friends %(for 10 years)) // are for both sides, belongs <-, has ->
+* (onDelete has: %orders %cascade) // cascade, restrict or unlink (default) related entities on delete
+* (incr myEntity %views 1) // atomic incr, decr, appendTo and compareAndSet, see atomic.go
+* (near store: lat lng radius: 5000 limit: 20) // spatial queries on tags indexed with geoIndex, see geo.go
+* (putBlob bytes contentType: "image/png") // store a file, the reference returned can be a component, see blob.go
+* (hasRole principal %admin) // check a role of the principal bound by the server, see access.go
 * (relationOf myEntity yourEntity) // fetch all relationships between these two
 * (relationsOf myEntity %friends are: %(for 10 years) has: %(meet years ago)) // fetch every which meet criteraa
 * (select admin: (Fn [e] (and (> (hget %age) 22) (= (hget %name) "Pedro"))))
+* (each admin: (Fn [e] (> (hget e %age) 22)) (Fn [e] (emit e))) // visit matches without building a result
 * (delete admin: (Fn [e] (and (> (hget %age) 22) (= (hget %name) "Pedro"))))
 * (update admin:
         (Fn [e]
@@ -37,23 +44,46 @@ import (
 var edb *badger.DB
 
 func OpenDB(baseDir string) string {
-	var err error
-	storagePath := filepath.Join(baseDir, "/.storage")
-	absStoragePath, errFile := filepath.Abs(storagePath)
+	absStoragePath, errFile := StoragePath(baseDir)
 	if errFile != nil {
 		log.Fatal(errFile)
 	}
 
-	db, err := badger.Open(badger.DefaultOptions(absStoragePath))
+	opts, err := WithEncryption(badger.DefaultOptions(absStoragePath))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := badger.Open(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	edb = db
+	maintenance, err = NewMaintenance(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maintenance.Start()
+
+	// entries of transactions committed before a crash
+	relayOutbox()
+
+	hooksPath = filepath.Join(baseDir, hooksDir)
+	accessPath = filepath.Join(baseDir, accessDir)
 	return absStoragePath
 }
 
+// StoragePath returns the absolute path of the entity database for a base dir
+func StoragePath(baseDir string) (string, error) {
+	return filepath.Abs(filepath.Join(baseDir, "/.storage"))
+}
+
 func CloseDB() {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	maintenance.Stop()
 	edb.Close()
 }
 
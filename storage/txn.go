@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"sync"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/glycerine/zygomys/v9/zygo"
+)
+
+var (
+	envTxns   = make(map[*zygo.Zlisp]*badger.Txn)
+	envTxnsMu sync.RWMutex
+)
+
+// bindTxn makes storage functions called from env join txn instead of opening
+// their own transactions, the returned function unbinds it
+func bindTxn(env *zygo.Zlisp, txn *badger.Txn) func() {
+	envTxnsMu.Lock()
+	defer envTxnsMu.Unlock()
+	envTxns[env] = txn
+
+	return func() {
+		envTxnsMu.Lock()
+		defer envTxnsMu.Unlock()
+		delete(envTxns, env)
+	}
+}
+
+// txnOf returns the transaction bound to env, nil if there is none
+func txnOf(env *zygo.Zlisp) *badger.Txn {
+	envTxnsMu.RLock()
+	defer envTxnsMu.RUnlock()
+	return envTxns[env]
+}
+
+// update runs fn in the transaction bound to env or in a new read-write transaction,
+// relaying the outbox once that one commits
+func update(env *zygo.Zlisp, fn func(txn *badger.Txn) error) error {
+	if txn := txnOf(env); txn != nil {
+		return fn(txn)
+	}
+
+	return commit(fn)
+}
+
+// view runs fn in the transaction bound to env or in a new read-only transaction
+func view(env *zygo.Zlisp, fn func(txn *badger.Txn) error) error {
+	if txn := txnOf(env); txn != nil {
+		return fn(txn)
+	}
+
+	return edb.View(fn)
+}
@@ -2,17 +2,16 @@ package storage
 
 import (
 	"errors"
-	"strings"
 
 	badger "github.com/dgraph-io/badger/v4"
 	"github.com/glycerine/zygomys/v9/zygo"
 	"github.com/seapvnk/qokl/parser"
 )
 
-// FnEntityDeleteAll return all entities that matches
-// Lisp (updateAll admin: (fn [e] (begin ...) e) (fn [e] (and (> (hget %age) 22) (= (hget name) "Pedro"))))
+// FnEntityUpdateAll update all entities that matches, writes are committed in batches. Returns the report.
+// Lisp (update admin: (fn [e] (begin ...) e) (fn [e] (and (> (hget %age) 22) (= (hget name) "Pedro"))) progress: (fn [report] ...))
 func FnEntityUpdateAll(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
-	if len(args) != 3 {
+	if len(args) < 3 {
 		return parser.SignalWrongArgs()
 	}
 
@@ -31,79 +30,121 @@ func FnEntityUpdateAll(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sex
 		return parser.SignalWrongArgs()
 	}
 
-	count := int64(0)
-	edb.Update(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		query := makeTagQuery(tag.Name())
-		for it.Seek(query); it.ValidForPrefix(query); it.Next() {
-			item := it.Item()
-			key := strings.Replace(string(item.Key()), string(query), "", int(1))
-			updated, errUpdate := updateRowInQuery(env, txn, key, mapfn, predicate)
+	options, err := parser.Options(args[3:])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	progress, err := bulkProgress(env, options)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	var ids []string
+	view(env, func(txn *badger.Txn) error {
+		ids = tagEntityIDs(txn, tag.Name())
+		return nil
+	})
 
+	g := guardOf(env)
+	writer := newBulkWriter(env, 0, bulkBatchSize, progress)
+	for _, chunk := range chunks(ids, bulkBatchSize) {
+		// run lisp functions before opening the write transaction
+		updates := map[string]map[string]any{}
+		var matched []string
+		for _, key := range chunk {
+			obj, errUpdate := updateRowInQuery(env, key, mapfn, predicate)
 			if errUpdate != nil {
-				return errUpdate
+				writer.matched(1)
+				writer.fail(key, errUpdate)
+				continue
 			}
-			if updated {
-				count++
+
+			if obj != nil {
+				updates[key] = obj
+				matched = append(matched, key)
 			}
 		}
-		return nil
-	})
 
-	return &zygo.SexpInt{Val: count}, nil
+		writer.matched(len(matched))
+		err := writer.write(matched, func(txn *badger.Txn, key string) error {
+			if err := allowUpdate(txn, g, key, updates[key]); err != nil {
+				return err
+			}
+
+			_, err := updateEntity(txn, key, updates[key])
+			return err
+		})
+
+		if err != nil {
+			return parser.SignalErr(env, err)
+		}
+	}
+
+	return reportToSexp(env, &writer.report), nil
 }
 
-func updateRowInQuery(env *zygo.Zlisp, txn *badger.Txn, key string, mapfn *zygo.SexpFunction, predicate *zygo.SexpFunction) (bool, error) {
+// updateRowInQuery returns the components to set on a matching entity, nil if it does not match
+func updateRowInQuery(env *zygo.Zlisp, key string, mapfn *zygo.SexpFunction, predicate *zygo.SexpFunction) (map[string]any, error) {
 	entityHash := retrieveEntity(env, key)
-	result, err := env.Apply(predicate, []zygo.Sexp{entityHash})
-	if err == nil {
-		result, isBool := result.(*zygo.SexpBool)
-		if !isBool {
-			return false, nil
-		}
+	if !canRead(env, key, entityHash) || !entityMatches(env, entityHash, predicate) {
+		return nil, nil
+	}
 
-		if result.Val {
-			applyHash, errApply := env.Apply(mapfn, []zygo.Sexp{entityHash})
-			if errApply != nil {
-				return false, errApply
-			}
+	applyHash, errApply := env.Apply(mapfn, []zygo.Sexp{entityHash})
+	if errApply != nil {
+		return nil, errApply
+	}
 
-			resultHash, isHash := applyHash.(*zygo.SexpHash)
-			if !isHash {
-				return false, errors.New("update function should always return a hash")
-			}
+	resultHash, isHash := applyHash.(*zygo.SexpHash)
+	if !isHash {
+		return nil, errors.New("update function should always return a hash")
+	}
 
-			var setParams []zygo.Sexp
-			setParams = append(setParams, zygo.SexpNull)
-			numPairs := zygo.HashCountKeys(resultHash)
-			for i := 0; i < numPairs; i++ {
-				pair, err := resultHash.HashPairi(i)
-				if err != nil {
-					continue
-				}
-
-				hashkey, ok := pair.Head.(*zygo.SexpSymbol)
-				if !ok {
-					continue
-				}
-
-				if hashkey.Name() == "id" {
-					continue
-				}
-
-				hashval, okVal := pair.Tail.(*zygo.SexpPair)
-				if !okVal {
-					continue
-				}
-
-				setParams = append(setParams, hashkey)
-				setParams = append(setParams, hashval.Head)
-			}
+	return hashToGo(resultHash), nil
+}
 
-			setComponents(txn, env, key, setParams)
-		}
+// updateEntity write components of an existing entity running its update hooks, returns the entity written
+func updateEntity(txn *badger.Txn, objID string, obj map[string]any) (map[string]any, error) {
+	tags := entityTags(txn, objID)
+	obj["id"] = objID
+
+	obj, err := runHooks(txn, hookBeforeUpdate, tags, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeComponents(txn, objID, obj); err != nil {
+		return nil, err
+	}
+
+	if err := indexGeo(txn, objID, tags); err != nil {
+		return nil, err
+	}
+
+	return runHooks(txn, hookAfterUpdate, tags, obj)
+}
+
+// allowUpdate checks an update against the entity before and after it, so rows can't be moved
+// out of a predicate's reach
+func allowUpdate(txn *badger.Txn, g *guard, objID string, obj map[string]any) error {
+	if g == nil {
+		return nil
+	}
+
+	tags := entityTags(txn, objID)
+	current := readEntity(txn, objID)
+	if err := g.allow(accessUpdate, tags, current); err != nil {
+		return err
+	}
+
+	updated := make(map[string]any, len(current)+len(obj))
+	for key, value := range current {
+		updated[key] = value
+	}
+	for key, value := range obj {
+		updated[key] = value
 	}
 
-	return true, nil
+	return g.allow(accessUpdate, tags, updated)
 }
@@ -18,13 +18,23 @@ func FnAddTag(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error)
 	}
 
 	objID := getEntityIDFromQuery(args[1])
-	err := edb.Update(func(txn *badger.Txn) error {
+	g := guardOf(env)
+	err := update(env, func(txn *badger.Txn) error {
+		if err := allowUpdate(txn, g, objID, nil); err != nil {
+			return err
+		}
+
+		// a tag granted to an entity must allow inserting it
+		if err := g.allow(accessInsert, tagNames(args[0]), readEntity(txn, objID)); err != nil {
+			return err
+		}
+
 		err := addTags(txn, env, objID, args[0])
 		return err
 	})
 
 	if err != nil {
-		return parser.SignalErr(env, zygo.WrongNargs)
+		return parser.SignalErr(env, err)
 	}
 
 	return parser.SignalOk(env)
@@ -36,10 +46,36 @@ func addTags(txn *badger.Txn, env *zygo.Zlisp, objID string, tagArg zygo.Sexp) e
 		return errors.New("entity does not exists")
 	}
 
+	tags := tagNames(tagArg)
+	if err := setTags(txn, objID, tags); err != nil {
+		return err
+	}
+
+	return indexGeo(txn, objID, tags)
+}
+
+// setTags write tag entries and their reverse index
+func setTags(txn *badger.Txn, objID string, tags []string) error {
+	for _, tagName := range tags {
+		if err := txn.Set(makeTagEntry(tagName, objID), []byte("1")); err != nil {
+			return err
+		}
+
+		if err := txn.Set(makeTagEntryReverse(tagName, objID), []byte("1")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tagNames read tags from a symbol or a list of symbols
+func tagNames(tagArg zygo.Sexp) []string {
+	var names []string
+
 	switch tagArg := tagArg.(type) {
 	case *zygo.SexpSymbol:
-		tagName := tagArg.Name()
-		txn.Set(makeTagEntry(tagName, objID), []byte("1"))
+		names = append(names, tagArg.Name())
 	case *zygo.SexpPair:
 		pair := tagArg
 		ok := true
@@ -47,16 +83,14 @@ func addTags(txn *badger.Txn, env *zygo.Zlisp, objID string, tagArg zygo.Sexp) e
 			var sym *zygo.SexpSymbol
 			sym, ok = pair.Head.(*zygo.SexpSymbol)
 			if ok {
-				tagName := sym.Name()
-				txn.Set(makeTagEntry(tagName, objID), []byte("1"))
-				txn.Set(makeTagEntryReverse(tagName, objID), []byte("1"))
+				names = append(names, sym.Name())
 			}
 
 			pair, ok = pair.Tail.(*zygo.SexpPair)
 		}
 	}
 
-	return nil
+	return names
 }
 
 // FnEntityInsert insert an entity at database
@@ -66,62 +100,183 @@ func FnEntityInsert(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp,
 		return zygo.SexpNull, zygo.WrongNargs
 	}
 
-	var obj map[string]interface{}
 	objID := uuid.NewString()
+	obj := argsToComponents(args[1:])
+	tags := tagNames(args[0])
+	obj["id"] = objID
+	if err := guardOf(env).allow(accessInsert, tags, obj); err != nil {
+		return parser.SignalErr(env, err)
+	}
 
-	err := edb.Update(func(txn *badger.Txn) error {
-		// insert entry
-		err := txn.Set(makeEntityEntry(objID), []byte("1"))
-		if err != nil {
-			return err
+	err := update(env, func(txn *badger.Txn) error {
+		var err error
+		obj, err = insertEntity(txn, objID, tags, obj)
+		return err
+	})
+
+	if err != nil {
+		return zygo.SexpNull, err
+	}
+
+	return parser.ToSexp(env, obj), nil
+}
+
+// FnEntityInsertMany insert entities in batches, returns a report with the ids of every row
+// Lisp (insertMany %(admin user) [(hash name: "Pedro") (hash name: "Sergio")] progress: (fn [report] ...))
+func FnEntityInsertMany(env *zygo.Zlisp, name string, args []zygo.Sexp) (zygo.Sexp, error) {
+	if len(args) < 2 {
+		return parser.SignalWrongArgs()
+	}
+
+	rows, rowsOk := args[1].(*zygo.SexpArray)
+	if !rowsOk {
+		return parser.SignalErr(env, errors.New("insertMany: second arg must be an array of hashes"))
+	}
+
+	options, err := parser.Options(args[2:])
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	progress, err := bulkProgress(env, options)
+	if err != nil {
+		return parser.SignalErr(env, err)
+	}
+
+	tags := tagNames(args[0])
+	g := guardOf(env)
+	ids := make([]string, len(rows.Val))
+	components := make(map[string]map[string]any, len(rows.Val))
+	for i, row := range rows.Val {
+		ids[i] = uuid.NewString()
+		if hash, isHash := row.(*zygo.SexpHash); isHash {
+			components[ids[i]] = hashToGo(hash)
 		}
+	}
 
-		// add tags
-		if errNotFound := addTags(txn, env, objID, args[0]); errNotFound != nil {
-			return err
+	writer := newBulkWriter(env, len(ids), bulkBatchSize, progress)
+	err = writer.write(ids, func(txn *badger.Txn, objID string) error {
+		obj, ok := components[objID]
+		if !ok {
+			return errors.New("row must be a hash")
 		}
 
-		// store object keys
-		obj = setComponents(txn, env, objID, args)
+		obj["id"] = objID
+		if err := g.allow(accessInsert, tags, obj); err != nil {
+			return err
+		}
 
+		_, err := insertEntity(txn, objID, tags, obj)
 		return err
 	})
 
 	if err != nil {
-		return zygo.SexpNull, err
+		return parser.SignalErr(env, err)
 	}
 
+	report := reportToSexp(env, &writer.report).(*zygo.SexpHash)
+	report.HashSet(env.MakeSymbol("ids"), parser.ToSexp(env, ids))
+
+	return report, nil
+}
+
+// insertEntity write a new entity running its insert hooks, returns the entity written
+func insertEntity(txn *badger.Txn, objID string, tags []string, obj map[string]any) (map[string]any, error) {
 	obj["id"] = objID
-	return parser.ToSexp(env, obj), nil
+	obj, err := runHooks(txn, hookBeforeInsert, tags, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := txn.Set(makeEntityEntry(objID), []byte("1")); err != nil {
+		return nil, err
+	}
+
+	if err := setTags(txn, objID, tags); err != nil {
+		return nil, err
+	}
+
+	if err := writeComponents(txn, objID, obj); err != nil {
+		return nil, err
+	}
+
+	if err := indexGeo(txn, objID, tags); err != nil {
+		return nil, err
+	}
+
+	return runHooks(txn, hookAfterInsert, tags, obj)
 }
 
-// setComponents insert/update components keys for a obj
-func setComponents(txn *badger.Txn, env *zygo.Zlisp, objID string, args []zygo.Sexp) map[string]interface{} {
-	obj := make(map[string]interface{})
-
-	for i := 1; i < len(args)-1; i += 2 {
-		key := args[i]
-		value := args[i+1]
-		keySym, ok := key.(*zygo.SexpSymbol)
-		if ok {
-			goVal, parserError := parser.SexpToGo(value)
-			if parserError != nil {
-				continue
-			}
+// writeComponents insert/update components keys for a obj, values that can't be stored are dropped from obj
+func writeComponents(txn *badger.Txn, objID string, obj map[string]any) error {
+	for key, value := range obj {
+		if key == "id" {
+			continue
+		}
 
-			data, err := json.Marshal(StoredValue{
-				Value: goVal,
-			})
+		data, err := json.Marshal(StoredValue{
+			Value: value,
+		})
 
-			if err != nil {
-				continue
-			}
+		if err != nil {
+			delete(obj, key)
+			continue
+		}
 
-			err = txn.Set(makeEntityComponentEntry(keySym.Name(), objID), data)
-			if err == nil {
-				obj[keySym.Name()] = goVal
-			}
+		if err := txn.Set(makeEntityComponentEntry(key, objID), data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// argsToComponents read `name: value` pairs, values that can't be converted are skipped
+func argsToComponents(args []zygo.Sexp) map[string]any {
+	obj := make(map[string]any)
+
+	for i := 0; i < len(args)-1; i += 2 {
+		keySym, ok := args[i].(*zygo.SexpSymbol)
+		if !ok {
+			continue
+		}
+
+		goVal, parserError := parser.SexpToGo(args[i+1])
+		if parserError != nil {
+			continue
+		}
+		obj[keySym.Name()] = goVal
+	}
+
+	return obj
+}
+
+// hashToGo convert an entity hash to components, values that can't be converted are skipped
+func hashToGo(hash *zygo.SexpHash) map[string]any {
+	obj := make(map[string]any)
+
+	numPairs := zygo.HashCountKeys(hash)
+	for i := 0; i < numPairs; i++ {
+		pair, err := hash.HashPairi(i)
+		if err != nil {
+			continue
+		}
+
+		hashkey, ok := pair.Head.(*zygo.SexpSymbol)
+		if !ok {
+			continue
+		}
+
+		hashval, okVal := pair.Tail.(*zygo.SexpPair)
+		if !okVal {
+			continue
+		}
+
+		goVal, parserError := parser.SexpToGo(hashval.Head)
+		if parserError != nil {
+			continue
 		}
+		obj[hashkey.Name()] = goVal
 	}
 
 	return obj
@@ -0,0 +1,162 @@
+package tasks
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// taskConfig delivery settings of a task, read from `// key: value` comments
+// at the top of its file:
+//
+//	// maxAttempts: 5
+//	// backoff: 2s
+//	// maxBackoff: 1m
+//	// cron: 0 3 * * *
+//	// missed: once
+//	// concurrency: 2
+//	// rate: 10
+//	// stream: orders
+//
+// rate is the number of jobs started per second, unlimited when unset. A task with
+// a stream consumes its records in order instead of serving its queue.
+type taskConfig struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	cron        *cronSchedule
+	missed      string
+	concurrency int
+	rate        float64
+	stream      string
+}
+
+// cachedConfig config of a task file, read again when the file changes
+type cachedConfig struct {
+	modTime time.Time
+	config  taskConfig
+	err     error
+}
+
+func (listener *Listener) configOf(path string, info os.FileInfo) cachedConfig {
+	cached, ok := listener.configs[path]
+	if !ok || !cached.modTime.Equal(info.ModTime()) {
+		config, err := readTaskConfig(path)
+		cached = cachedConfig{modTime: info.ModTime(), config: config, err: err}
+		listener.configs[path] = cached
+
+		// logged once per change of the file, its queue is not served until it is fixed
+		if err != nil {
+			log.Printf("[tasks] invalid config: %s\n", err.Error())
+		}
+	}
+
+	return cached
+}
+
+func readTaskConfig(path string) (taskConfig, error) {
+	config := taskConfig{
+		maxAttempts: defaultMaxAttempts,
+		backoff:     defaultBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		missed:      missedSkip,
+		concurrency: defaultConcurrency,
+	}
+
+	headers, err := readHeaders(path)
+	if err != nil {
+		return config, err
+	}
+
+	for key, value := range headers {
+		switch key {
+		case "maxAttempts":
+			attempts, err := strconv.Atoi(value)
+			if err != nil || attempts < 1 {
+				return config, fmt.Errorf("%s: maxAttempts must be a positive integer", path)
+			}
+			config.maxAttempts = attempts
+		case "backoff", "maxBackoff":
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return config, fmt.Errorf("%s: %s must be a duration like 2s", path, key)
+			}
+
+			if key == "backoff" {
+				config.backoff = duration
+			} else {
+				config.maxBackoff = duration
+			}
+		case "cron":
+			schedule, err := parseCron(value)
+			if err != nil {
+				return config, fmt.Errorf("%s: %w", path, err)
+			}
+			config.cron = schedule
+		case "missed":
+			if value != missedSkip && value != missedOnce {
+				return config, fmt.Errorf("%s: missed must be %s or %s", path, missedSkip, missedOnce)
+			}
+			config.missed = value
+		case "concurrency":
+			concurrency, err := strconv.Atoi(value)
+			if err != nil || concurrency < 1 {
+				return config, fmt.Errorf("%s: concurrency must be a positive integer", path)
+			}
+			config.concurrency = concurrency
+		case "rate":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate <= 0 {
+				return config, fmt.Errorf("%s: rate must be a positive number of jobs per second", path)
+			}
+			config.rate = rate
+		case "stream":
+			config.stream = value
+		}
+	}
+
+	return config, nil
+}
+
+// delay before retrying a job that failed its attempt-th run
+func (config taskConfig) delay(attempt int) time.Duration {
+	delay := config.backoff
+	for i := 1; i < attempt && delay < config.maxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, config.maxBackoff)
+}
+
+// readHeaders reads the `// key: value` comments before the first line of code
+func readHeaders(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	headers := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		comment, isComment := strings.CutPrefix(line, "//")
+		if !isComment {
+			break
+		}
+
+		if key, value, found := strings.Cut(comment, ":"); found {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	return headers, scanner.Err()
+}
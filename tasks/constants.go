@@ -1,5 +1,40 @@
 package tasks
 
+import "time"
+
 const (
 	tasksDir = "tasks"
+
+	// jobs running at once across queues
+	maxWorkersEnv = "QOKL_MAX_WORKERS"
+
+	// how often task directories are checked for changes
+	taskRescanInterval = time.Second
+)
+
+const (
+	// runs of a job before it is moved to the dead letters of its queue
+	defaultMaxAttempts = 3
+	// delay before the first retry, doubled on every attempt
+	defaultBackoff = time.Second
+	// longest delay between retries
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+const (
+	// missed cron slots are skipped, only the runs on time happen
+	missedSkip = "skip"
+	// missed cron slots are coalesced in a single run
+	missedOnce = "once"
+
+	// how late a cron slot can be triggered before it counts as missed
+	cronGrace = time.Minute
+	// next runs listed per schedule
+	scheduleRuns = 5
+)
+
+const (
+	defaultMaxWorkers = 64
+	// jobs of a queue running at once
+	defaultConcurrency = 4
 )
@@ -0,0 +1,178 @@
+package tasks
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule when a task runs, from a `// cron: ...` header.
+// Standard 5 field expressions (minute hour day-of-month month day-of-week) with
+// lists, ranges and steps are supported, as well as @hourly, @daily, @weekly,
+// @monthly, @yearly and @every <duration>.
+type cronSchedule struct {
+	expr   string
+	every  time.Duration
+	fields [5]map[int]bool
+	// day of month and day of week restricted, a day matching either one matches
+	anyDay bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// bounds of minute, hour, day of month, month and day of week
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	schedule := &cronSchedule{expr: expr}
+
+	if every, found := strings.CutPrefix(expr, "@every "); found {
+		duration, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("cron %q: @every needs a positive duration", expr)
+		}
+		schedule.every = duration
+		return schedule, nil
+	}
+
+	if descriptor, ok := cronDescriptors[expr]; ok {
+		expr = descriptor
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields", expr)
+	}
+
+	for i, field := range fields {
+		values, err := parseCronField(field, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+		schedule.fields[i] = values
+	}
+
+	// sunday can be written 7
+	if schedule.fields[4][7] {
+		schedule.fields[4][0] = true
+	}
+
+	schedule.anyDay = fields[2] != "*" && fields[4] != "*"
+	return schedule, nil
+}
+
+func parseCronField(field string, low, high int) (map[int]bool, error) {
+	values := map[int]bool{}
+	if field == "*" {
+		for v := low; v <= high; v++ {
+			values[v] = true
+		}
+		return values, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", part)
+			}
+		}
+
+		start, end := low, high
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				end = high
+			}
+		}
+
+		// day of week accepts 7 for sunday
+		maxValue := high
+		if low == 0 && high == 6 {
+			maxValue = 7
+		}
+
+		if start < low || end > maxValue || start > end {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, low, high)
+		}
+
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+
+	return values, nil
+}
+
+// next returns the first slot strictly after t
+func (schedule *cronSchedule) next(t time.Time) time.Time {
+	if schedule.every > 0 {
+		return t.Truncate(schedule.every).Add(schedule.every)
+	}
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case !schedule.fields[3][int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !schedule.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !schedule.fields[1][t.Hour()]:
+			// truncating would round in absolute time, off in zones with half hour offsets
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !schedule.fields[0][t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (schedule *cronSchedule) dayMatches(t time.Time) bool {
+	dom := schedule.fields[2][t.Day()]
+	dow := schedule.fields[4][int(t.Weekday())]
+	if schedule.anyDay {
+		return dom || dow
+	}
+
+	return dom && dow
+}
+
+// nextRuns returns the count slots following t
+func (schedule *cronSchedule) nextRuns(t time.Time, count int) []time.Time {
+	runs := make([]time.Time, 0, count)
+	for len(runs) < count {
+		t = schedule.next(t)
+		if t.IsZero() {
+			break
+		}
+		runs = append(runs, t)
+	}
+
+	return runs
+}
@@ -1,68 +1,331 @@
 package tasks
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/glycerine/zygomys/v9/zygo"
 	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/parser"
 )
 
 type Listener struct {
 	baseDir string
 	closed  chan struct{}
+	configs map[string]cachedConfig
+	pools   map[string]*pool
+	workers chan struct{}
+
+	// running is held by Run while it looks for jobs
+	running sync.Mutex
+	// freed is signaled when a worker is released
+	freed chan struct{}
+	// handlers counts the jobs and stream records being handled
+	handlers sync.WaitGroup
+	tasks    []taskFile
+	topics   []string
+	// modification times of tasks/ and its subdirectories when they were last walked
+	dirs     map[string]time.Time
+	rescanAt time.Time
+	wake     time.Time
+}
+
+// taskFile a task script, its queue is named after its path in tasks/
+type taskFile struct {
+	path  string
+	queue string
+	info  os.FileInfo
 }
 
 func New(baseDir string) *Listener {
 	return &Listener{
 		baseDir: baseDir,
 		closed:  make(chan struct{}),
+		configs: map[string]cachedConfig{},
+		pools:   map[string]*pool{},
+		workers: make(chan struct{}, maxWorkers()),
+		freed:   make(chan struct{}, 1),
 	}
 }
 
+// Close stops Run, returning once it and the jobs it started no longer use the store
 func (listener *Listener) Close() {
 	close(listener.closed)
+
+	listener.running.Lock()
+	defer listener.running.Unlock()
+	listener.handlers.Wait()
 }
 
+// Run serves the queues of the task files until the listener is closed. It sleeps
+// until a message is queued, a worker is freed, a delayed job, a cron slot, a lease or an outbox retry is due,
+// task directories are checked for changes every taskRescanInterval.
 func (listener *Listener) Run() {
-	tasksPath := filepath.Join(listener.baseDir, tasksDir)
-
 	for {
+		listener.running.Lock()
 		select {
 		case <-listener.closed:
+			listener.running.Unlock()
 			return
 		default:
-			_ = filepath.Walk(tasksPath, func(path string, info os.FileInfo, err error) error {
-				if err != nil || info.IsDir() {
-					return nil
-				}
+		}
+
+		queued := core.StoreQueued()
+		now := time.Now()
+
+		if !now.Before(listener.rescanAt) {
+			listener.scan()
+			listener.rescanAt = now.Add(taskRescanInterval)
+
+			if _, err := core.StoreTrimStreams(now); err != nil {
+				log.Printf("[tasks] trimming streams failed: %s\n", err.Error())
+			}
+		}
+		listener.wake = listener.rescanAt
+
+		if due, found := core.StoreNextDue(); found && !due.After(now) {
+			if _, err := core.StorePromoteDue(now); err != nil {
+				log.Printf("[tasks] promoting delayed jobs failed: %s\n", err.Error())
+			}
+		}
+
+		if due, found := core.StoreNextDue(); found {
+			listener.wakeAt(due)
+		}
+
+		if expiry, found := core.StoreNextLeaseExpiry(); found && !expiry.After(now) {
+			if _, err := core.StoreExpireLeases(now); err != nil {
+				log.Printf("[tasks] expiring leases failed: %s\n", err.Error())
+			}
+		}
+
+		if expiry, found := core.StoreNextLeaseExpiry(); found {
+			listener.wakeAt(expiry)
+		}
+
+		if retry, found := core.StoreNextRelay(); found && !retry.After(now) {
+			core.RelayOutbox()
+		}
+
+		if retry, found := core.StoreNextRelay(); found {
+			listener.wakeAt(retry)
+		}
+
+		for _, task := range listener.tasks {
+			listener.triggerCron(task.path, task.info, task.queue, now)
+			listener.serve(task.path, task.info, task.queue)
+		}
+
+		listener.running.Unlock()
+
+		timer := time.NewTimer(time.Until(listener.wake))
+		select {
+		case <-listener.closed:
+			timer.Stop()
+			return
+		case <-queued:
+		case <-listener.freed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// wakeAt makes Run look for jobs again at t at the latest
+func (listener *Listener) wakeAt(t time.Time) {
+	if !t.IsZero() && t.Before(listener.wake) {
+		listener.wake = t
+	}
+}
 
-				rel, _ := filepath.Rel(tasksPath, path)
-				queue := strings.TrimSuffix(strings.ToLower(rel), ".lisp")
+// scan discovers the task files when tasks/ or one of its subdirectories changed, tasks in
+// a subdirectory handle the topic named after it. Otherwise the known files are only stat'ed
+// so edits of their config are seen.
+func (listener *Listener) scan() {
+	if !listener.dirsChanged() {
+		for i, task := range listener.tasks {
+			if info, err := os.Stat(task.path); err == nil {
+				listener.tasks[i].info = info
+			}
+		}
+		return
+	}
+
+	tasksPath := filepath.Join(listener.baseDir, tasksDir)
+	tasks := []taskFile{}
+	topics := []string{}
+	// a missing tasks/ is walked again until it exists
+	dirs := map[string]time.Time{tasksPath: {}}
+
+	_ = filepath.Walk(tasksPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
 
-				msg, err := core.StoreDequeue(queue)
-				if err == nil && len(msg) > 0 {
-					go handleTask(path, msg)
-				}
+		if info.IsDir() {
+			dirs[path] = info.ModTime()
+			return nil
+		}
+
+		rel, _ := filepath.Rel(tasksPath, path)
+		queue := strings.TrimSuffix(strings.ToLower(filepath.ToSlash(rel)), ".lisp")
+		tasks = append(tasks, taskFile{path: path, queue: queue, info: info})
+		if strings.Contains(queue, "/") {
+			topics = append(topics, queue)
+		}
 
-				return nil
-			})
+		return nil
+	})
 
-			time.Sleep(10 * time.Millisecond)
+	listener.tasks = tasks
+	listener.dirs = dirs
+	if listener.topics == nil || !slices.Equal(topics, listener.topics) {
+		if err := core.StoreSetSubscriptions(topics); err != nil {
+			log.Printf("[tasks] subscribing topic handlers failed: %s\n", err.Error())
+			return
 		}
+		listener.topics = topics
 	}
 }
 
-func handleTask(queuePath string, msg []byte) {
+// dirsChanged tells if a directory walked by scan was modified or removed since
+func (listener *Listener) dirsChanged() bool {
+	if listener.dirs == nil {
+		return true
+	}
+
+	for dir, modTime := range listener.dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serve starts jobs of a queue while it has some waiting and free workers
+func (listener *Listener) serve(path string, info os.FileInfo, queue string) {
+	cached := listener.configOf(path, info)
+	if cached.err != nil {
+		return
+	}
+
+	config := cached.config
+	if config.stream != "" {
+		listener.consume(path, queue, config)
+		return
+	}
+
+	for {
+		release, ok := listener.acquire(queue, config, time.Now())
+		if !ok {
+			return
+		}
+
+		job, err := core.StoreReserve(queue)
+		if err != nil {
+			release(false)
+			return
+		}
+
+		listener.handlers.Add(1)
+		go func() {
+			defer listener.handlers.Done()
+			defer release(true)
+			handleTask(path, job, config)
+		}()
+	}
+}
+
+// handleTask runs a job, completing it with the value of the script on success. Failed jobs
+// are retried with exponential backoff until they run out of attempts and become dead letters.
+func handleTask(queuePath string, job *core.Job, config taskConfig) {
+	result, err := runTask(queuePath, job)
+	if err == nil {
+		if err := core.StoreComplete(job, result); err != nil {
+			log.Printf("[task - %s] ack failed: %s\n", queuePath, err.Error())
+		}
+		return
+	}
+
+	log.Printf("[task - %s] attempt %d/%d failed: %s\n", queuePath, job.Attempts, config.maxAttempts, err.Error())
+	if err := core.StoreFail(job, err, config.maxAttempts, config.delay(job.Attempts)); err != nil {
+		log.Printf("[task - %s] failing job failed: %s\n", queuePath, err.Error())
+	}
+}
+
+// runTask executes a task script and returns its value, script errors and panics fail the job
+func runTask(queuePath string, job *core.Job) (value any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
 	vm := core.NewVM().UseStoreModule()
+	scheduledAt := ""
+	if !job.ScheduledAt.IsZero() {
+		scheduledAt = job.ScheduledAt.Format(time.RFC3339)
+	}
+
 	vm.AddVariables(map[string]any{
-		"msg": msg,
+		"msg":         job.Msg,
+		"attempts":    job.Attempts,
+		"scheduledAt": scheduledAt,
+		"jobId":       job.ID,
 	})
 
-	_, err := vm.Execute(queuePath)
+	if job.Stream != "" {
+		vm.AddVariables(map[string]any{
+			"stream": job.Stream,
+			"offset": int64(job.Offset),
+		})
+	}
+
+	if job.Workflow != "" {
+		results, err := core.StoreWorkflowResults(job.Workflow)
+		if err != nil {
+			return nil, err
+		}
+
+		vm.AddVariables(map[string]any{
+			"workflowId": job.Workflow,
+			"results":    results,
+		})
+	}
+
+	result, err := vm.Execute(queuePath)
 	if err != nil {
-		log.Printf("[task - %s] error: %s\n", queuePath, err.Error())
+		return nil, err
 	}
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return resultOf(result.Value), nil
+}
+
+// resultOf converts the value of a task script to be stored with its job status,
+// msgpack values are decoded
+func resultOf(sexp zygo.Sexp) any {
+	if raw, isRaw := sexp.(*zygo.SexpRaw); isRaw {
+		if value, err := zygo.MsgpackToGo(raw.Val); err == nil {
+			return value
+		}
+	}
+
+	value, err := parser.SexpToGo(sexp)
+	if err != nil {
+		return sexp.SexpString(nil)
+	}
+
+	return value
 }
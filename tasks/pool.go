@@ -0,0 +1,107 @@
+package tasks
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pool workers running the jobs of a queue, limited by the concurrency and
+// rate headers of its task
+type pool struct {
+	mu      sync.Mutex
+	running int
+	tokens  float64
+	filled  time.Time
+}
+
+// acquire takes a worker for a job of queue, false when the global cap, the
+// concurrency or the rate limit of the queue is reached. release frees it,
+// giving the rate limit token back when no job ran, and wakes up Run.
+func (listener *Listener) acquire(queue string, config taskConfig, now time.Time) (release func(ran bool), ok bool) {
+	select {
+	case listener.workers <- struct{}{}:
+	default:
+		return nil, false
+	}
+
+	p, found := listener.pools[queue]
+	if !found {
+		p = &pool{tokens: burstOf(config.rate), filled: now}
+		listener.pools[queue] = p
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.running >= config.concurrency {
+		<-listener.workers
+		return nil, false
+	}
+
+	if !p.take(config.rate, now) {
+		listener.wakeAt(now.Add(p.refillIn(config.rate)))
+		<-listener.workers
+		return nil, false
+	}
+	p.running++
+
+	return func(ran bool) {
+		p.mu.Lock()
+		p.running--
+		if !ran && config.rate > 0 {
+			p.tokens++
+		}
+		p.mu.Unlock()
+		<-listener.workers
+
+		select {
+		case listener.freed <- struct{}{}:
+		default:
+		}
+	}, true
+}
+
+// take spends a token of the rate limit, the bucket refills at rate tokens per
+// second and holds a second worth of them. A zero rate is unlimited.
+func (p *pool) take(rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	p.tokens = min(burstOf(rate), p.tokens+now.Sub(p.filled).Seconds()*rate)
+	p.filled = now
+	if p.tokens < 1 {
+		return false
+	}
+
+	p.tokens--
+	return true
+}
+
+// refillIn time until the bucket holds a token again
+func (p *pool) refillIn(rate float64) time.Duration {
+	return time.Duration((1 - p.tokens) / rate * float64(time.Second))
+}
+
+func burstOf(rate float64) float64 {
+	return max(1, rate)
+}
+
+// maxWorkers jobs running at once across queues, from QOKL_MAX_WORKERS
+func maxWorkers() int {
+	value := os.Getenv(maxWorkersEnv)
+	if value == "" {
+		return defaultMaxWorkers
+	}
+
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers < 1 {
+		log.Printf("[tasks] %s must be a positive integer, using %d\n", maxWorkersEnv, defaultMaxWorkers)
+		return defaultMaxWorkers
+	}
+
+	return workers
+}
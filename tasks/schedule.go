@@ -0,0 +1,114 @@
+package tasks
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/seapvnk/qokl/core"
+)
+
+// Schedule next runs of a cron scheduled task
+type Schedule struct {
+	Task string      `json:"task"`
+	Cron string      `json:"cron"`
+	Next []time.Time `json:"next"`
+}
+
+// triggerCron queues a job for the latest slot of the task schedule that is due and
+// wakes up Run at the next one. Slots later than cronGrace are missed, they are skipped
+// or coalesced in a single run depending on the missed header. A schedule seen for the
+// first time starts at now.
+func (listener *Listener) triggerCron(path string, info os.FileInfo, queue string, now time.Time) {
+	cached := listener.configOf(path, info)
+	schedule := cached.config.cron
+	if cached.err != nil || schedule == nil {
+		return
+	}
+
+	last, found, err := core.StoreCronLast(queue)
+	if err != nil {
+		log.Printf("[cron - %s] error: %s\n", path, err.Error())
+		return
+	}
+
+	if !found {
+		_, err := core.StoreCronTrigger(queue, now, false)
+		if err != nil {
+			log.Printf("[cron - %s] error: %s\n", path, err.Error())
+		}
+		listener.wakeAt(schedule.next(now))
+		return
+	}
+
+	slot := schedule.next(last)
+	if slot.IsZero() {
+		return
+	}
+
+	if slot.After(now) {
+		listener.wakeAt(slot)
+		return
+	}
+
+	// latest slot due, earlier ones are missed
+	if schedule.every > 0 {
+		slot = now.Truncate(schedule.every)
+	} else {
+		for next := schedule.next(slot); !next.IsZero() && !next.After(now); next = schedule.next(slot) {
+			slot = next
+		}
+	}
+
+	listener.wakeAt(schedule.next(slot))
+
+	run := now.Sub(slot) <= cronGrace || cached.config.missed == missedOnce
+	queued, err := core.StoreCronTrigger(queue, slot, run)
+	switch {
+	case err != nil:
+		log.Printf("[cron - %s] error: %s\n", path, err.Error())
+	case !run:
+		log.Printf("[cron - %s] missed run of %s skipped\n", path, slot.Format(time.RFC3339))
+	case !queued:
+		log.Printf("[cron - %s] run of %s skipped, the previous one is still pending\n", path, slot.Format(time.RFC3339))
+	}
+}
+
+// Schedules lists the cron scheduled tasks of a base dir with their next runs
+func Schedules(baseDir string, now time.Time) ([]Schedule, error) {
+	tasksPath := filepath.Join(baseDir, tasksDir)
+	schedules := []Schedule{}
+
+	err := filepath.Walk(tasksPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		config, err := readTaskConfig(path)
+		if err != nil {
+			return err
+		}
+
+		if config.cron == nil {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(tasksPath, path)
+		schedules = append(schedules, Schedule{
+			Task: strings.TrimSuffix(strings.ToLower(rel), ".lisp"),
+			Cron: config.cron.expr,
+			Next: config.cron.nextRuns(now, scheduleRuns),
+		})
+
+		return nil
+	})
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Task < schedules[j].Task
+	})
+
+	return schedules, err
+}
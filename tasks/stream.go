@@ -0,0 +1,80 @@
+package tasks
+
+import (
+	"log"
+	"time"
+
+	"github.com/seapvnk/qokl/core"
+)
+
+// consume runs a task on the next record of its stream, the task name is the consumer group.
+// Records are handled one at a time in order, a failed one is retried with backoff until it
+// runs out of attempts and is skipped.
+func (listener *Listener) consume(path string, group string, config taskConfig) {
+	sequential := config
+	sequential.concurrency = 1
+
+	now := time.Now()
+	release, ok := listener.acquire(group, sequential, now)
+	if !ok {
+		return
+	}
+
+	position, err := core.StoreGroup(config.stream, group)
+	if err != nil {
+		log.Printf("[task - %s] reading offset of %s failed: %s\n", path, config.stream, err.Error())
+		release(false)
+		return
+	}
+
+	if now.Before(position.RetryAt) {
+		listener.wakeAt(position.RetryAt)
+		release(false)
+		return
+	}
+
+	records, err := core.StoreReadStream(config.stream, position.Offset, 1)
+	if err != nil || len(records) == 0 {
+		release(false)
+		return
+	}
+
+	job := &core.Job{
+		Queue:    group,
+		Msg:      records[0].Msg,
+		Attempts: position.Attempts + 1,
+		Stream:   config.stream,
+		Offset:   records[0].Offset,
+	}
+
+	listener.handlers.Add(1)
+	go func() {
+		defer listener.handlers.Done()
+		defer release(true)
+		handleRecord(path, job, config)
+	}()
+}
+
+// handleRecord runs a task on a stream record, committing the offset of its group on success
+func handleRecord(path string, job *core.Job, config taskConfig) {
+	_, err := runTask(path, job)
+	if err == nil {
+		if err := core.StoreCommitOffset(job.Stream, job.Queue, job.Offset+1); err != nil {
+			log.Printf("[task - %s] commit of offset %d failed: %s\n", path, job.Offset, err.Error())
+		}
+		return
+	}
+
+	log.Printf("[task - %s] attempt %d/%d at offset %d failed: %s\n", path, job.Attempts, config.maxAttempts, job.Offset, err.Error())
+	if job.Attempts >= config.maxAttempts {
+		log.Printf("[task - %s] skipping offset %d of %s\n", path, job.Offset, job.Stream)
+		if err := core.StoreCommitOffset(job.Stream, job.Queue, job.Offset+1); err != nil {
+			log.Printf("[task - %s] commit of offset %d failed: %s\n", path, job.Offset, err.Error())
+		}
+		return
+	}
+
+	if _, err := core.StoreRetryRecord(job.Stream, job.Queue, time.Now().Add(config.delay(job.Attempts))); err != nil {
+		log.Printf("[task - %s] retrying offset %d failed: %s\n", path, job.Offset, err.Error())
+	}
+}
@@ -0,0 +1 @@
+(hash read: %(user admin))
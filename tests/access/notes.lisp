@@ -0,0 +1,6 @@
+(hash read: %(user admin)
+      insert: %(user admin)
+      update: (fn [e principal]
+                (or (hasRole principal %admin)
+                    (== (hget e %owner) (hget principal %id))))
+      delete: %(admin))
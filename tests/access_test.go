@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/seapvnk/qokl/storage"
+)
+
+func queryAs(t *testing.T, router http.Handler, user string, role string, payload string) any {
+	req := httptest.NewRequest("POST", "/query", bytes.NewBuffer([]byte(payload)))
+	if user != "" {
+		req.Header.Set("X-User", user)
+		req.Header.Set("X-Role", role)
+	}
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var body any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Cannot decode %q: %v", resp.Body.String(), err)
+	}
+
+	return body
+}
+
+func hasError(body any) bool {
+	hash, ok := body.(map[string]any)
+	_, isErr := hash["error"]
+	return ok && isErr
+}
+
+// Checks if access rules of a tag are enforced for the principal of the request
+func TestAccessRulesAreEnforced(t *testing.T) {
+	dbPath := storage.OpenDB("./")
+	defer os.RemoveAll(dbPath)
+	router := setupTestDB(t)
+
+	if body := queryAs(t, router, "", "", `(insert notes: owner: "nobody")`); !hasError(body) {
+		t.Errorf("Expected anonymous insert to be denied, got %v", body)
+	}
+
+	note := queryAs(t, router, "alice", "user", `(insert notes: owner: "alice" text: "hi")`)
+	if hasError(note) {
+		t.Fatalf("Expected alice to insert a note, got %v", note)
+	}
+
+	if rows := queryAs(t, router, "", "", `(select notes: (fn [e] true))`); rows != nil && len(rows.([]any)) != 0 {
+		t.Errorf("Expected anonymous callers to see no notes, got %v", rows)
+	}
+
+	if rows := queryAs(t, router, "bob", "user", `(select notes: (fn [e] true))`); rows == nil || len(rows.([]any)) != 1 {
+		t.Errorf("Expected bob to read the note, got %v", rows)
+	}
+
+	update := `(update notes: (fn [e] (hash text: "edited")) (fn [e] true))`
+	if report, ok := queryAs(t, router, "bob", "user", update).(map[string]any); !ok || report["done"] != float64(0) {
+		t.Errorf("Expected bob not to update alice's note, got %v", report)
+	}
+
+	if report, ok := queryAs(t, router, "alice", "user", update).(map[string]any); !ok || report["done"] != float64(1) {
+		t.Errorf("Expected alice to update her note, got %v", report)
+	}
+
+	id := note.(map[string]any)["id"].(string)
+	if body := queryAs(t, router, "alice", "user", `(deleteEntity "`+id+`")`); !hasError(body) {
+		t.Errorf("Expected delete to be reserved to admins, got %v", body)
+	}
+
+	queryAs(t, router, "root", "admin", `(deleteEntity "`+id+`")`)
+	if count := storage.CountTag("notes"); count != 0 {
+		t.Errorf("Expected the note to be deleted, got %d notes", count)
+	}
+}
+
+// Checks if relationships, tag counts, components and blobs only show what the principal may read
+func TestIntrospectionRespectsAccessRules(t *testing.T) {
+	dbPath := storage.OpenDB("./")
+	defer os.RemoveAll(dbPath)
+	router := setupTestDB(t)
+
+	first := queryAs(t, router, "alice", "user", `(insert notes: owner: "alice" text: "first")`)
+	second := queryAs(t, router, "alice", "user", `(insert notes: owner: "alice" text: "second")`)
+	if hasError(first) || hasError(second) {
+		t.Fatalf("Expected alice to insert notes, got %v %v", first, second)
+	}
+
+	firstID := first.(map[string]any)["id"].(string)
+	secondID := second.(map[string]any)["id"].(string)
+	link := queryAs(t, router, "alice", "user", `(relationship "`+firstID+`" "`+secondID+`" are: %linked)`)
+	if hasError(link) {
+		t.Fatalf("Expected alice to link her notes, got %v", link)
+	}
+
+	relationships := `(relationshipsOf "` + firstID + `" are: %linked)`
+	if rows := queryAs(t, router, "", "", relationships); rows != nil && len(rows.([]any)) != 0 {
+		t.Errorf("Expected anonymous callers to see no relationships, got %v", rows)
+	}
+
+	if rows := queryAs(t, router, "bob", "user", relationships); rows == nil || len(rows.([]any)) != 1 {
+		t.Errorf("Expected bob to see the relationship, got %v", rows)
+	}
+
+	if count := queryAs(t, router, "", "", `(countTag notes:)`); count != float64(0) {
+		t.Errorf("Expected anonymous callers to count no notes, got %v", count)
+	}
+
+	if count := queryAs(t, router, "bob", "user", `(countTag notes:)`); count != float64(2) {
+		t.Errorf("Expected bob to count 2 notes, got %v", count)
+	}
+
+	if components := queryAs(t, router, "", "", `(componentsOf notes:)`); components != nil && len(components.([]any)) != 0 {
+		t.Errorf("Expected anonymous callers to see no components, got %v", components)
+	}
+
+	info, err := storage.PutBlob([]byte("secret"), "text/plain")
+	if err != nil {
+		t.Fatalf("put blob failed: %v", err)
+	}
+
+	if body := queryAs(t, router, "", "", `(getBlob "`+info.ID+`")`); !hasError(body) {
+		t.Errorf("Expected anonymous callers not to read blobs, got %v", body)
+	}
+
+	if body := queryAs(t, router, "bob", "user", `(getBlob "`+info.ID+`")`); hasError(body) {
+		t.Errorf("Expected bob to read the blob, got %v", body)
+	}
+}
+
+// Checks if delete rules and spatial indexes can't be changed by the principal of a request
+func TestSchemaChangesAreDenied(t *testing.T) {
+	dbPath := storage.OpenDB("./")
+	defer os.RemoveAll(dbPath)
+	router := setupTestDB(t)
+
+	if body := queryAs(t, router, "root", "admin", `(onDelete has: %notes %cascade)`); !hasError(body) {
+		t.Errorf("Expected onDelete to be denied, got %v", body)
+	}
+
+	if body := queryAs(t, router, "root", "admin", `(geoIndex notes: %lat %lng)`); !hasError(body) {
+		t.Errorf("Expected geoIndex to be denied, got %v", body)
+	}
+
+	if body := queryAs(t, router, "", "", `(onDelete has: %notes %cascade)`); !hasError(body) {
+		t.Errorf("Expected onDelete to be denied to anonymous callers, got %v", body)
+	}
+}
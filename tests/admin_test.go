@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/storage"
+)
+
+// token the admin routes are configured with in tests
+const adminToken = "secret"
+
+// Checks if the storage admin endpoint reports tags and requires the admin token
+func TestAdminStorageReport(t *testing.T) {
+	storage.OpenDB("./.storage")
+	defer os.RemoveAll("./.storage")
+	router := setupTestDB(t)
+
+	payload := `(insert %(admin user) name: "Pedro" age: 23)`
+	req := httptest.NewRequest("POST", "/query", bytes.NewBuffer([]byte(payload)))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest("GET", "/admin/storage", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 without an admin token configured, got %d", resp.Code)
+	}
+
+	t.Setenv("QOKL_ADMIN_TOKEN", adminToken)
+	req = httptest.NewRequest("GET", "/admin/storage", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without token, got %d", resp.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/storage/tags/user", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", resp.Code)
+	}
+
+	var body struct {
+		Count      int64    `json:"count"`
+		Components []string `json:"components"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Cannot decode: %v", err)
+	}
+
+	if body.Count != 1 || len(body.Components) != 2 {
+		t.Errorf("Expected 1 user with 2 components, got %+v", body)
+	}
+}
+
+// Checks if queues can be inspected, paused, moved and purged through the admin endpoints
+func TestAdminQueues(t *testing.T) {
+	core.OpenStore()
+	defer core.CloseStore()
+	router, _ := setupTestTask(t)
+	t.Setenv("QOKL_ADMIN_TOKEN", adminToken)
+
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`
+		(dispatch reports: (msgpack (hash value: "bulk")))
+		(dispatch reports: (msgpack (hash value: "urgent")) priority: 5)
+		(pauseQueue reports:)
+		(queueLength reports:)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	if length, ok := result.Value.(*zygo.SexpInt); !ok || length.Val != 2 {
+		t.Fatalf("Expected 2 waiting messages, got %v", result.Value)
+	}
+
+	if _, err := core.StoreReserve("reports"); err == nil {
+		t.Errorf("Expected a paused queue not to be served")
+	}
+
+	var info core.QueueInfo
+	adminJSON(t, router, "GET", "/admin/queues/reports", &info)
+	if info.Length != 2 || !info.Paused || info.Lanes[5] != 1 {
+		t.Errorf("Expected 2 messages in a paused queue, got %+v", info)
+	}
+
+	var peeked struct {
+		Priority int            `json:"priority"`
+		Msg      map[string]any `json:"msg"`
+	}
+	adminJSON(t, router, "GET", "/admin/queues/reports/peek", &peeked)
+	if peeked.Priority != 5 || peeked.Msg["value"] != "urgent" {
+		t.Errorf("Expected the urgent message first, got %+v", peeked)
+	}
+
+	var moved struct {
+		Count int `json:"count"`
+	}
+	adminJSON(t, router, "POST", "/admin/queues/reports/move/archive", &moved)
+	if moved.Count != 2 {
+		t.Errorf("Expected 2 moved messages, got %d", moved.Count)
+	}
+
+	var messages []map[string]any
+	adminJSON(t, router, "GET", "/admin/queues/archive/messages?limit=1", &messages)
+	if len(messages) != 1 {
+		t.Errorf("Expected 1 listed message, got %v", messages)
+	}
+
+	var purged struct {
+		Count int `json:"count"`
+	}
+	adminJSON(t, router, "DELETE", "/admin/queues/archive/messages", &purged)
+	if purged.Count != 2 {
+		t.Errorf("Expected 2 purged messages, got %d", purged.Count)
+	}
+
+	var queues []core.QueueInfo
+	adminJSON(t, router, "POST", "/admin/queues/reports/resume", &info)
+	adminJSON(t, router, "GET", "/admin/queues", &queues)
+	if info.Paused || len(queues) != 2 || queues[0].Length+queues[1].Length != 0 {
+		t.Errorf("Expected both queues empty and resumed, got %+v", queues)
+	}
+}
+
+func adminJSON(t *testing.T, router http.Handler, method string, path string, out any) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("%s %s: expected 200 OK, got %d %s", method, path, resp.Code, resp.Body.String())
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("%s %s: cannot decode: %v", method, path, err)
+	}
+}
+
+// Checks if large queues are moved and purged whole, releasing the cron schedules and workflows of their jobs
+func TestPurgeAndMoveLargeQueues(t *testing.T) {
+	core.OpenStore()
+	defer core.CloseStore()
+
+	dispatches := strings.Repeat(`(dispatch backlog: (msgpack (hash value: "bulk")))`, 600)
+	result, err := core.NewVM().UseStoreModule().ExecuteString(dispatches + `
+		(startWorkflow [(hash name: %backlog)] (msgpack (hash value: "step")))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+	workflowID := result.Value.(*zygo.SexpStr).S
+
+	if queued, err := core.StoreCronTrigger("backlog", time.Now(), true); err != nil || !queued {
+		t.Fatalf("Expected a cron job to be queued, got %v %v", queued, err)
+	}
+
+	moved, err := core.StoreMove("backlog", "archive")
+	if err != nil || moved != 602 {
+		t.Fatalf("Expected 602 moved messages, got %d %v", moved, err)
+	}
+
+	purged, err := core.StorePurge("archive")
+	if err != nil || purged != 602 {
+		t.Fatalf("Expected 602 purged messages, got %d %v", purged, err)
+	}
+
+	info, err := core.StoreQueueInfo("archive")
+	if err != nil || info.Length != 0 {
+		t.Errorf("Expected an empty queue, got %+v %v", info, err)
+	}
+
+	if queued, err := core.StoreCronTrigger("backlog", time.Now(), true); err != nil || !queued {
+		t.Errorf("Expected the schedule to run again once its job is moved, got %v %v", queued, err)
+	}
+
+	workflow, err := core.StoreWorkflow(workflowID)
+	if err != nil || workflow.Status != core.WorkflowFailed || workflow.Steps[0].Status != core.StepFailed {
+		t.Errorf("Expected the purged step to fail its workflow, got %+v %v", workflow, err)
+	}
+}
@@ -0,0 +1 @@
+(each user: (fn [e] true) (fn [e] (emit e)))
@@ -0,0 +1,46 @@
+package tests
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/storage"
+)
+
+// Checks if concurrent increments of a component are never lost
+func TestConcurrentIncrements(t *testing.T) {
+	storage.OpenDB("./.storage")
+	defer os.RemoveAll("./.storage")
+
+	result, err := core.NewVM().ExecuteString(`(hget (insert post: views: 0) %id)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("insert failed: %v %v", err, result.Error)
+	}
+	id := result.Value.(*zygo.SexpStr).S
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if result, err := core.NewVM().ExecuteString(`(incr "` + id + `" %views)`); err != nil || result.Error != nil {
+					t.Errorf("incr failed: %v %v", err, result.Error)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	result, err = core.NewVM().ExecuteString(`(hget (entity "` + id + `") %views)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("entity lookup failed: %v %v", err, result.Error)
+	}
+
+	if views, ok := result.Value.(*zygo.SexpFloat); !ok || views.Val != 200 {
+		t.Errorf("Expected 200 views, got %v", result.Value)
+	}
+}
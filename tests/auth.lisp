@@ -0,0 +1,3 @@
+(def user (hget headers (str2sym "X-User") ""))
+(cond (== user "") nil
+      (hash id: user roles: [(hget headers (str2sym "X-Role") "user")]))
@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/storage"
+)
+
+// Checks if an uploaded blob can be downloaded whole and by ranges spanning chunks
+func TestBlobUploadAndRangeDownload(t *testing.T) {
+	storage.OpenDB("./.storage")
+	defer os.RemoveAll("./.storage")
+	router := setupTestDB(t)
+
+	data := make([]byte, 2<<20+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	req := httptest.NewRequest("POST", "/blobs", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/x-test")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected anonymous uploads to be rejected, got %d", resp.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/blobs", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/x-test")
+	req.Header.Set("X-User", "alice")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201 Created, got %d", resp.Code)
+	}
+
+	if contentType := resp.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected a JSON reference, got %s", contentType)
+	}
+
+	var info storage.BlobInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("Cannot decode: %v", err)
+	}
+
+	if info.Size != int64(len(data)) || info.Chunks != 3 {
+		t.Errorf("Expected 3 chunks of %d bytes, got %+v", len(data), info)
+	}
+
+	req = httptest.NewRequest("GET", "/blobs/"+info.ID, nil)
+	req.Header.Set("X-User", "alice")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if body, _ := io.ReadAll(resp.Body); !bytes.Equal(body, data) {
+		t.Errorf("Expected the whole blob, got %d bytes", len(body))
+	}
+
+	if contentType := resp.Header().Get("Content-Type"); contentType != "application/x-test" {
+		t.Errorf("Expected the uploaded content type, got %s", contentType)
+	}
+
+	req = httptest.NewRequest("GET", "/blobs/"+info.ID, nil)
+	req.Header.Set("X-User", "alice")
+	req.Header.Set("Range", "bytes=1048570-1048585")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusPartialContent {
+		t.Fatalf("Expected status 206 Partial Content, got %d", resp.Code)
+	}
+
+	if body, _ := io.ReadAll(resp.Body); !bytes.Equal(body, data[1048570:1048586]) {
+		t.Errorf("Expected bytes across the chunk boundary, got %v", body)
+	}
+
+	// the same content uploaded again references the stored blob and the content type it is served with
+	req = httptest.NewRequest("POST", "/blobs", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/x-other")
+	req.Header.Set("X-User", "bob")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var again storage.BlobInfo
+	if err := json.NewDecoder(resp.Body).Decode(&again); err != nil || again.ID != info.ID || again.ContentType != "application/x-test" {
+		t.Errorf("Expected the same blob with its stored content type, got %+v %v", again, err)
+	}
+
+	req = httptest.NewRequest("GET", "/blobs/"+info.ID, nil)
+	req.Header.Set("X-User", "alice")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if contentType := resp.Header().Get("Content-Type"); contentType != again.ContentType {
+		t.Errorf("Expected the download to match the reference content type %s, got %s", again.ContentType, contentType)
+	}
+
+	req = httptest.NewRequest("GET", "/blobs/missing", nil)
+	req.Header.Set("X-User", "alice")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 Not Found, got %d", resp.Code)
+	}
+}
+
+// Checks if a blob reference stored as a component reads back the blob
+func TestBlobReferenceAsComponent(t *testing.T) {
+	storage.OpenDB("./.storage")
+	defer os.RemoveAll("./.storage")
+
+	result, err := core.NewVM().ExecuteString(`
+		(def avatar (insert user: name: "Pedro" avatar: (putBlob "png bytes" contentType: "image/png")))
+		(getBlob (hget (entity (hget avatar %id)) %avatar))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("query failed: %v %v", err, result.Error)
+	}
+
+	if raw, ok := result.Value.(*zygo.SexpRaw); !ok || string(raw.Val) != "png bytes" {
+		t.Errorf("Expected the blob bytes, got %v", result.Value)
+	}
+}
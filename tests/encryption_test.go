@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/application"
+	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/storage"
+)
+
+// Checks if an encrypted storage stays readable after rotating its key
+func TestEncryptedStorageKeyRotation(t *testing.T) {
+	baseDir := t.TempDir()
+	t.Setenv("QOKL_ENCRYPTION_KEY", "hex:0123456789abcdef0123456789abcdef")
+
+	storage.OpenDB(baseDir)
+	result, err := core.NewVM().ExecuteString(`(hget (insert user: name: "Pedro") %id)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("insert failed: %v %v", err, result.Error)
+	}
+	id := result.Value.(*zygo.SexpStr).S
+	storage.CloseDB()
+
+	newKeyFile := filepath.Join(baseDir, "new.key")
+	if err := os.WriteFile(newKeyFile, []byte("hex:fedcba9876543210fedcba9876543210\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := application.RotateKey(baseDir, newKeyFile); err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+
+	t.Setenv("QOKL_ENCRYPTION_KEY", "")
+	t.Setenv("QOKL_ENCRYPTION_KEY_FILE", newKeyFile)
+	storage.OpenDB(baseDir)
+	defer storage.CloseDB()
+
+	result, err = core.NewVM().ExecuteString(`(hget (entity "` + id + `") %name)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("entity lookup failed: %v %v", err, result.Error)
+	}
+
+	if name, ok := result.Value.(*zygo.SexpStr); !ok || name.S != "Pedro" {
+		t.Errorf("Expected name to be Pedro, got %v", result.Value)
+	}
+}
+
+// Checks if a 32 hex character key needs a prefix and decodes to an AES-128 key
+func TestHexEncryptionKey(t *testing.T) {
+	t.Setenv("QOKL_ENCRYPTION_KEY", "0123456789abcdef0123456789abcdef")
+	if _, err := storage.LoadEncryptionKey(); err == nil {
+		t.Error("Expected an unprefixed 32 hex character key to be rejected as ambiguous")
+	}
+
+	t.Setenv("QOKL_ENCRYPTION_KEY", "hex:0123456789abcdef0123456789abcdef")
+	key, err := storage.LoadEncryptionKey()
+	if err != nil {
+		t.Fatalf("hex key failed: %v", err)
+	}
+	if len(key) != 16 || key[0] != 0x01 || key[15] != 0xef {
+		t.Errorf("Expected the hex key to decode to 16 bytes, got %x", key)
+	}
+
+	t.Setenv("QOKL_ENCRYPTION_KEY", "raw:0123456789abcdef0123456789abcdef")
+	if key, err := storage.LoadEncryptionKey(); err != nil || len(key) != 32 {
+		t.Errorf("Expected the raw key to be 32 bytes, got %x %v", key, err)
+	}
+
+	t.Setenv("QOKL_ENCRYPTION_KEY", "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	if key, err := storage.LoadEncryptionKey(); err != nil || len(key) != 32 {
+		t.Errorf("Expected the unprefixed 64 hex character key to decode to 32 bytes, got %x %v", key, err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/seapvnk/qokl/core"
@@ -241,3 +242,95 @@ func TestAddTagAndSelectByTag(t *testing.T) {
 		t.Errorf("Expected entity with id %s to be in the select result, but it was not found", id)
 	}
 }
+
+// Checks if relationships can only link existing entities
+func TestRelationshipRequiresExistingEntities(t *testing.T) {
+	storage.OpenDB("./.storage")
+	defer os.RemoveAll("./.storage")
+	router := setupTestDB(t)
+
+	payload := `(relationship (insert user: name: "Pedro") "missing-id" are: %friends)`
+	req := httptest.NewRequest("POST", "/query", bytes.NewBuffer([]byte(payload)))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", resp.Code)
+	}
+
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Cannot decode: %v", err)
+	}
+
+	if msg, ok := body["error"].(string); !ok || !strings.Contains(msg, "missing-id does not exist") {
+		t.Errorf("Expected a missing entity error, got %v", body)
+	}
+}
+
+// Checks if entities can be streamed as NDJSON
+func TestStreamEntitiesAsNDJSON(t *testing.T) {
+	storage.OpenDB("./.storage")
+	defer os.RemoveAll("./.storage")
+	router := setupTestDB(t)
+
+	for _, name := range []string{"Pedro", "Sergio", "Maria"} {
+		payload := `(insert user: name: "` + name + `")`
+		req := httptest.NewRequest("POST", "/query", bytes.NewBuffer([]byte(payload)))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/api/export", nil),
+		httptest.NewRequest("POST", "/query", bytes.NewBuffer([]byte(`(select user: (fn [e] true))`))),
+	} {
+		req.Header.Set("Accept", "application/x-ndjson")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected 200 OK, got %d", resp.Code)
+		}
+
+		if contentType := resp.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+			t.Errorf("Expected NDJSON content type, got %q", contentType)
+		}
+
+		lines := strings.Split(strings.TrimSpace(resp.Body.String()), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("Expected 3 lines, got %q", resp.Body.String())
+		}
+
+		for _, line := range lines {
+			var entity map[string]any
+			if err := json.Unmarshal([]byte(line), &entity); err != nil || entity["name"] == nil {
+				t.Errorf("Expected an entity per line, got %q", line)
+			}
+		}
+	}
+}
+
+// Checks if a before hook can veto an insert
+func TestHookCanVetoInsert(t *testing.T) {
+	dbPath := storage.OpenDB("./")
+	defer os.RemoveAll(dbPath)
+	router := setupTestDB(t)
+
+	payload := `(insert audited: name: "forbidden")`
+	req := httptest.NewRequest("POST", "/query", bytes.NewBuffer([]byte(payload)))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Cannot decode: %v", err)
+	}
+
+	if msg, ok := body["error"].(string); !ok || !strings.Contains(msg, "vetoed") {
+		t.Errorf("Expected the insert to be vetoed, got %v", body)
+	}
+
+	if count := storage.CountTag("audited"); count != 0 {
+		t.Errorf("Expected no audited entity, got %d", count)
+	}
+}
@@ -0,0 +1 @@
+(insert audit: action: event target: (hget e %id))
@@ -0,0 +1 @@
+(not (hget e %locked false))
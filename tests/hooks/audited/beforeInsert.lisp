@@ -0,0 +1,5 @@
+(cond (== (hget e %name) "forbidden")
+      false
+      (begin
+        (hset e %slug (concat "slug-" (hget e %name)))
+        e))
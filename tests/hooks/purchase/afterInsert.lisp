@@ -0,0 +1 @@
+(dispatch receipts: (msgpack (hash purchase: (hget e %id))))
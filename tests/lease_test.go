@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/seapvnk/qokl/core"
+)
+
+// Checks if external workers can lease, extend, ack and nack jobs, and if expired leases are retried
+func TestLeaseJobs(t *testing.T) {
+	core.OpenStore()
+	defer core.CloseStore()
+	router, _ := setupTestTask(t)
+	t.Setenv("QOKL_ADMIN_TOKEN", adminToken)
+
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`
+		(dispatch external: (msgpack (hash value: "first")))
+		(dispatch external: (msgpack (hash value: "second")))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	var lease struct {
+		ID        string         `json:"id"`
+		JobID     string         `json:"jobId"`
+		Attempts  int            `json:"attempts"`
+		Msg       map[string]any `json:"msg"`
+		ExpiresAt time.Time      `json:"expiresAt"`
+	}
+	code := leaseRequest(t, router, "/jobs/external/lease", `{"visibilityTimeout": 10}`, &lease)
+	if code != http.StatusOK || lease.Msg["value"] != "first" || lease.Attempts != 1 {
+		t.Fatalf("Expected to lease the first job, got %d %+v", code, lease)
+	}
+
+	expiresAt := lease.ExpiresAt
+	code = leaseRequest(t, router, "/jobs/external/lease/"+lease.ID+"/extend", `{"visibilityTimeout": 60}`, &lease)
+	if code != http.StatusOK || !lease.ExpiresAt.After(expiresAt) {
+		t.Errorf("Expected the lease to be extended, got %d %v", code, lease.ExpiresAt)
+	}
+
+	if code := leaseRequest(t, router, "/jobs/other/lease/"+lease.ID+"/ack", ``, nil); code != http.StatusNotFound {
+		t.Errorf("Expected a lease of another queue to be rejected, got %d", code)
+	}
+
+	if code := leaseRequest(t, router, "/jobs/external/lease/"+lease.ID+"/ack", `{"result": {"sent": true}}`, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected the lease to be acked, got %d", code)
+	}
+
+	status, err := core.StoreJobStatus(lease.JobID)
+	if err != nil || status.Status != core.JobSucceeded || status.Result == nil {
+		t.Errorf("Expected the acked job to succeed with its result, got %+v %v", status, err)
+	}
+
+	// the second job is nacked, then its lease expires on its last attempt
+	code = leaseRequest(t, router, "/jobs/external/lease", `{"visibilityTimeout": 0.05, "maxAttempts": 2}`, &lease)
+	if code != http.StatusOK || lease.Msg["value"] != "second" {
+		t.Fatalf("Expected to lease the second job, got %d %+v", code, lease)
+	}
+
+	if code := leaseRequest(t, router, "/jobs/external/lease/"+lease.ID+"/nack", `{"error": "smtp down"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected the lease to be nacked, got %d", code)
+	}
+
+	core.StorePromoteDue(time.Now())
+	code = leaseRequest(t, router, "/jobs/external/lease", `{"visibilityTimeout": 0.05, "maxAttempts": 2}`, &lease)
+	if code != http.StatusOK || lease.Attempts != 2 {
+		t.Fatalf("Expected the nacked job to be leased again, got %d %+v", code, lease)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if code := leaseRequest(t, router, "/jobs/external/lease", ``, nil); code != http.StatusNoContent {
+		t.Errorf("Expected the queue to be empty, got %d", code)
+	}
+
+	if code := leaseRequest(t, router, "/jobs/external/lease/"+lease.ID+"/ack", ``, nil); code != http.StatusNotFound {
+		t.Errorf("Expected an expired lease to be gone, got %d", code)
+	}
+
+	dead, err := core.StoreDeadLetters("external")
+	if err != nil || len(dead) != 1 || dead[0].LastError != "lease expired" {
+		t.Errorf("Expected the expired job to be a dead letter, got %+v %v", dead, err)
+	}
+}
+
+func leaseRequest(t *testing.T, router http.Handler, path string, body string, out any) int {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if out != nil && resp.Code == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s: cannot decode: %v", path, err)
+		}
+	}
+
+	return resp.Code
+}
+
+// Checks if a lease survives a restart without its job being queued again
+func TestLeaseSurvivesReopen(t *testing.T) {
+	t.Setenv("QOKL_CORE_STORE", t.TempDir())
+
+	core.OpenStore()
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`(dispatch external: (msgpack (hash value: "leased")))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	lease, err := core.StoreLease("external", time.Minute, 1)
+	if err != nil {
+		t.Fatalf("lease failed: %v", err)
+	}
+	core.CloseStore()
+
+	core.OpenStore()
+	defer core.CloseStore()
+
+	if _, err := core.StoreReserve("external"); !errors.Is(err, core.ErrQueueEmpty) {
+		t.Errorf("Expected the leased job to stay in flight, got %v", err)
+	}
+
+	if err := core.StoreAckLease(lease.ID, nil); err != nil {
+		t.Fatalf("Expected the lease to be acked after the restart: %v", err)
+	}
+
+	status, err := core.StoreJobStatus(lease.Job.ID)
+	if err != nil || status.Status != core.JobSucceeded {
+		t.Errorf("Expected the leased job to succeed, got %+v %v", status, err)
+	}
+
+	if info, err := core.StoreQueueInfo("external"); err != nil || info.Length != 0 || info.Inflight != 0 {
+		t.Errorf("Expected nothing left in the queue, got %+v %v", info, err)
+	}
+}
+
+// Checks if a cron schedule runs again once its job is acked or its lease expires on the last attempt
+func TestLeasedCronJobReleasesSchedule(t *testing.T) {
+	core.OpenStore()
+	defer core.CloseStore()
+
+	if queued, err := core.StoreCronTrigger("nightly", time.Now(), true); err != nil || !queued {
+		t.Fatalf("Expected a cron job to be queued, got %v %v", queued, err)
+	}
+
+	lease, err := core.StoreLease("nightly", time.Minute, 1)
+	if err != nil {
+		t.Fatalf("lease failed: %v", err)
+	}
+
+	if queued, _ := core.StoreCronTrigger("nightly", time.Now(), true); queued {
+		t.Fatalf("Expected the schedule to wait for its leased job")
+	}
+
+	if err := core.StoreAckLease(lease.ID, nil); err != nil {
+		t.Fatalf("ack failed: %v", err)
+	}
+
+	if queued, err := core.StoreCronTrigger("nightly", time.Now(), true); err != nil || !queued {
+		t.Fatalf("Expected the schedule to run again once its job is acked, got %v %v", queued, err)
+	}
+
+	if _, err := core.StoreLease("nightly", time.Millisecond, 1); err != nil {
+		t.Fatalf("lease failed: %v", err)
+	}
+
+	if expired, err := core.StoreExpireLeases(time.Now().Add(time.Second)); err != nil || expired != 1 {
+		t.Fatalf("Expected 1 expired lease, got %d %v", expired, err)
+	}
+
+	if queued, err := core.StoreCronTrigger("nightly", time.Now(), true); err != nil || !queued {
+		t.Errorf("Expected the schedule to run again once its job is dead, got %v %v", queued, err)
+	}
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/application"
+	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/storage"
+)
+
+// Checks if compaction keeps live entities and the background GC runs on its interval
+func TestCompactAndBackgroundGC(t *testing.T) {
+	baseDir := t.TempDir()
+
+	storage.OpenDB(baseDir)
+	result, err := core.NewVM().ExecuteString(`
+		(insert user: name: "Pedro")
+		(insert user: name: "Sergio")
+		(deleteAll user: (fn [e] (== (hget e %name) "Sergio")))
+		(hget (insert user: name: "Ana") %id)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("setup failed: %v %v", err, result.Error)
+	}
+	id := result.Value.(*zygo.SexpStr).S
+
+	// the storage directory is locked while the database is open
+	if _, err := application.Compact(baseDir); err == nil {
+		t.Errorf("Expected compaction of the open storage directory to fail")
+	}
+	storage.CloseDB()
+
+	if _, err := application.Compact(baseDir); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(baseDir, "MANIFEST")); !os.IsNotExist(err) {
+		t.Errorf("Expected no database to be created outside of the storage directory")
+	}
+
+	t.Setenv("QOKL_GC_INTERVAL", "10ms")
+	storage.OpenDB(baseDir)
+	defer storage.CloseDB()
+
+	if count := storage.CountTag("user"); count != 2 {
+		t.Errorf("Expected 2 users after compaction, got %d", count)
+	}
+
+	result, err = core.NewVM().ExecuteString(`(hget (entity "` + id + `") %name)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("entity lookup failed: %v %v", err, result.Error)
+	}
+
+	if name, ok := result.Value.(*zygo.SexpStr); !ok || name.S != "Ana" {
+		t.Errorf("Expected name to be Ana, got %v", result.Value)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if runs := storage.Stats().GC.Runs; runs == 0 {
+		t.Errorf("Expected the background GC to run")
+	}
+}
@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/glycerine/zygomys/v9/zygo"
+	"github.com/seapvnk/qokl/core"
+	"github.com/seapvnk/qokl/storage"
+)
+
+// waitForLength waits until a queue holds length messages
+func waitForLength(t *testing.T, queueName string, length int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, err := core.StoreQueueInfo(queueName)
+		if err == nil && info.Length == length {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d messages in %s, got %+v %v", length, queueName, info, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Checks if dispatches inside entity transactions are queued once they commit, and dropped when they fail
+func TestTransactionalOutbox(t *testing.T) {
+	dbPath := storage.OpenDB("./")
+	defer os.RemoveAll(dbPath)
+	core.OpenStore()
+	defer core.CloseStore()
+
+	// the afterInsert hook of purchase dispatches a receipt
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`(insert purchase: total: 10)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("insert failed: %v %v", err, result.Error)
+	}
+	waitForLength(t, "receipts", 1)
+
+	result, err = core.NewVM().UseStoreModule().ExecuteString(`
+		(transaction (fn []
+			(insert purchase: total: 20)
+			(dispatch receipts: (msgpack (hash note: "never sent")))
+			(assert false)))`)
+	if err == nil && result.Error == nil {
+		t.Fatalf("Expected the transaction to fail")
+	}
+
+	result, err = core.NewVM().UseStoreModule().ExecuteString(`
+		(transaction (fn []
+			(insert invoice: total: 5)
+			(dispatchIn receipts: 60 (msgpack (hash note: "later")))))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("transaction failed: %v %v", err, result.Error)
+	}
+
+	id, ok := result.Value.(*zygo.SexpStr)
+	if !ok {
+		t.Fatalf("Expected the transaction to return the job id, got %v", result.Value)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		status, err := core.StoreJobStatus(id.S)
+		if err == nil && status.Status == core.JobQueued {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the delayed job to be queued, got %+v %v", status, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the failed transaction wrote neither the entity nor the receipt
+	waitForLength(t, "receipts", 1)
+	if count := storage.CountTag("purchase"); count != 1 {
+		t.Errorf("Expected 1 purchase, got %d", count)
+	}
+
+	// relaying again does not queue twice
+	core.RelayOutbox()
+	waitForLength(t, "receipts", 1)
+}
+
+// Checks if an entry that keeps failing does not hold back the others and is parked once out of attempts
+func TestOutboxPoisonEntry(t *testing.T) {
+	dbPath := storage.OpenDB("./")
+	defer os.RemoveAll(dbPath)
+	defer storage.CloseDB()
+
+	// without the core store the relay after commit leaves the outbox alone
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`
+		(transaction (fn []
+			(dispatch poison: (msgpack (hash note: "never delivered")))
+			(dispatch receipts: (msgpack (hash note: "delivered")))))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("transaction failed: %v %v", err, result.Error)
+	}
+
+	var queued []string
+	deliver := func(entry storage.OutboxEntry) error {
+		if entry.Queue == "poison" {
+			return errors.New("queue unavailable")
+		}
+		queued = append(queued, entry.Queue)
+		return nil
+	}
+
+	relayed, err := storage.RelayOutbox(deliver)
+	if err == nil || relayed != 1 || len(queued) != 1 || queued[0] != "receipts" {
+		t.Fatalf("Expected the entry after the failing one to be relayed, got %d %v %v", relayed, queued, err)
+	}
+
+	for range 100 {
+		if _, err := storage.RelayOutbox(deliver); err == nil {
+			break
+		}
+	}
+
+	dead, err := storage.OutboxDeadLetters()
+	if err != nil || len(dead) != 1 || dead[0].Queue != "poison" || dead[0].Attempts < 2 {
+		t.Fatalf("Expected the failing entry to be parked after its attempts, got %+v %v", dead, err)
+	}
+
+	if relayed, err := storage.RelayOutbox(deliver); err != nil || relayed != 0 || len(queued) != 1 {
+		t.Errorf("Expected nothing left to relay, got %d %v %v", relayed, queued, err)
+	}
+}
@@ -0,0 +1,19 @@
+(def post (insert post: title: "hello" views: 1 status: "draft"))
+
+(assert (== 2 (incr post %views)))
+(assert (== 12 (incr post %views 10)))
+(assert (== 9 (decr post %views 3)))
+(assert (== 5 (incr post %likes 5)))
+(assert (== 9 (hget (entity post) %views)))
+(assert (== 10 (transaction (fn [] (incr post %views)))))
+
+(appendTo post %log "created")
+(def log (appendTo post %log "published"))
+(assert (== 2 (len log)))
+(assert (== "published" (aget (hget (entity post) %log) 1)))
+
+(assert (compareAndSet post %status "draft" "published"))
+(assert (not (compareAndSet post %status "draft" "archived")))
+(assert (== "published" (hget (entity post) %status)))
+
+true
@@ -0,0 +1,31 @@
+(def rows [])
+(for [(def i 0) (< i 700) (def i (+ i 1))]
+     (set rows (append rows (hash name: "bulk" index: i))))
+
+(def progressCalls 0)
+(def report
+     (insertMany %(bulk user) rows
+                 progress: (fn [r] (set progressCalls (+ progressCalls 1)))))
+
+(assert (== 700 (hget report %total)))
+(assert (== 700 (hget report %done)))
+(assert (== 0 (hget report %failed)))
+(assert (== 700 (len (hget report %ids))))
+(assert (>= progressCalls 2))
+(assert (== 700 (countTag bulk:)))
+
+(def updated
+     (update bulk:
+             (fn [e] (hset e %name "updated") e)
+             (fn [e] (< (hget e %index) 350))))
+(assert (== 350 (hget updated %done)))
+(assert (== 350 (hget updated %total)))
+(assert (== 350 (len (select bulk: (fn [e] (== "updated" (hget e %name)))))))
+
+(def deleted (deleteAll bulk: (fn [e] true)))
+(assert (== 700 (hget deleted %done)))
+(assert (== 700 (hget deleted %total)))
+(assert (== 0 (hget deleted %failed)))
+(assert (== 0 (countTag user:)))
+
+true
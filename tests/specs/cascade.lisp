@@ -0,0 +1,44 @@
+(onDelete has: %orders %cascade)
+(onDelete has: %invoices %restrict)
+
+(def customer (insert customer: name: "Pedro"))
+(def order1 (insert order: total: 10))
+(def order2 (insert order: total: 20))
+(def item (insert item: name: "book"))
+
+(relationship customer order1 has: %orders)
+(relationship customer order2 has: %orders)
+(relationship order1 item has: %items)
+
+(deleteEntity customer)
+(assert (== 0 (countTag customer:)))
+(assert (== 0 (countTag order:)))
+(assert (== 1 (countTag item:)))
+(assert (== 0 (len (relationshipsOf item belongs: %items))))
+
+(def seller (insert seller: name: "Sergio"))
+(def invoice (insert invoice: total: 30))
+(relationship seller invoice has: %invoices)
+
+(def restricted (deleteAll seller: (fn [e] true)))
+(assert (== 0 (hget restricted %done)))
+(assert (== 1 (hget restricted %failed)))
+(assert (== 1 (countTag seller:)))
+
+(onDelete has: %invoices %unlink)
+(assert (== 1 (hget (deleteAll seller: (fn [e] true)) %done)))
+(assert (== 1 (countTag invoice:)))
+
+(onDelete has: %parts %cascade)
+(def press (insert machine: name: "press"))
+(def gear (insert machine: name: "gear"))
+// deleteAll walks ids in order, the first one cascades to the second
+(cond (< (hget press %id) (hget gear %id)) (relationship press gear has: %parts)
+      (relationship gear press has: %parts))
+(def cascaded (deleteAll machine: (fn [e] true)))
+(assert (== 1 (hget cascaded %done)))
+(assert (== 0 (hget cascaded %failed)))
+(assert (== 1 (hget cascaded %total)))
+(assert (== 0 (countTag machine:)))
+
+true
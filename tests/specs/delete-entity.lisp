@@ -33,8 +33,8 @@
   (insert boilerplate: name: "e1")
   (insert boilerplate: name: "e2")
   (insert boilerplate: name: "e3"))
-(def deletedCount
+(def deleted
      (deleteAll boilerplate: (fn [e] (== 1 1))))
-(assert (== 3 deletedCount))
+(assert (== 3 (hget deleted %done)))
 
 true
@@ -0,0 +1,13 @@
+(insert %(admin user) name: "Pedro" age: 23)
+(insert user: name: "Sergio" age: 30)
+(insert user: name: "Maria" age: 41)
+
+(def total 0)
+(def visited
+     (each user: (fn [e] (> (hget e %age) 25))
+           (fn [e] (set total (+ total (hget e %age))))))
+
+(assert (== 2 visited))
+(assert (== 71 total))
+
+true
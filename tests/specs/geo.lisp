@@ -0,0 +1,32 @@
+(def a (insert store: name: "A" lat: -23.5595 lng: -46.6333))
+(geoIndex store: %lat %lng)
+
+(insert store: name: "B" lat: -23.5775 lng: -46.6333)
+(insert store: name: "C" lat: -22.9068 lng: -43.1729)
+(insert store: name: "D")
+
+// C moves next to the center, its old entry must be gone
+(update store: (fn [e] (hash lat: -23.5505 lng: -46.6400)) (fn [e] (== (hget e %name) "C")))
+
+(def nearby (near store: -23.5505 -46.6333 radius: 2000))
+(assert (== 2 (len nearby)))
+(assert (== "C" (hget (aget nearby 0) %name)))
+(assert (== "A" (hget (aget nearby 1) %name)))
+(assert (< (hget (aget nearby 1) %distance) 1100))
+
+(assert (== 1 (len (near store: -23.5505 -46.6333 radius: 5000 limit: 1))))
+(assert (== 0 (len (near store: -22.9068 -43.1729 radius: 5000))))
+
+(def boxed (within store: -23.58 -46.64 -23.555 -46.63))
+(assert (== 2 (len boxed)))
+
+// the antimeridian splits the search box in one box on each side
+(insert store: name: "E" lat: 0.0 lng: 179.99)
+(def across (near store: 0.0 -179.99 radius: 5000))
+(assert (== 1 (len across)))
+(assert (== "E" (hget (aget across 0) %name)))
+
+(deleteEntity a)
+(assert (== 1 (len (near store: -23.5505 -46.6333 radius: 2000))))
+
+true
@@ -0,0 +1,24 @@
+(def pedro (insert audited: name: "Pedro"))
+(assert (== "slug-Pedro" (hget pedro %slug)))
+(assert (== "slug-Pedro" (hget (entity pedro) %slug)))
+(assert (== 1 (countTag audit:)))
+
+(update audited: (fn [e] (hset e %name "Sergio") e) (fn [e] true))
+(assert (== 2 (countTag audit:)))
+(assert (== 2 (len (select audit: (fn [e] (== (hget e %target) (hget pedro %id)))))))
+
+(insert audited: name: "Locked" locked: true)
+
+// writes vetoed by a hook are reported, done and failed add up to the entities matched
+(def updated (update audited: (fn [e] (hset e %reviewed true) e) (fn [e] true)))
+(assert (== 2 (hget updated %total)))
+(assert (== 1 (hget updated %done)))
+(assert (== 1 (hget updated %failed)))
+(assert (== 1 (len (hget updated %errors))))
+
+(def deleted (deleteAll audited: (fn [e] true)))
+(assert (== 1 (hget deleted %done)))
+(assert (== 1 (hget deleted %failed)))
+(assert (== 1 (countTag audited:)))
+
+true
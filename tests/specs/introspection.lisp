@@ -0,0 +1,29 @@
+(def pedro (insert %(admin user) name: "Pedro" age: 23))
+(def sergio (insert user: name: "Sergio" email: "sergio@mail.com"))
+(def removed (insert user: name: "Removed"))
+(deleteEntity removed)
+
+(assert (== 2 (countTag user:)))
+(assert (== 1 (countTag admin:)))
+(assert (== 0 (countTag nobody:)))
+
+(def allTags (tags))
+(assert (== 2 (len allTags)))
+(assert (== "admin" (aget allTags 0)))
+(assert (== "user" (aget allTags 1)))
+
+(def userComponents (componentsOf user:))
+(assert (== 3 (len userComponents)))
+(assert (== "age" (aget userComponents 0)))
+(assert (== "email" (aget userComponents 1)))
+(assert (== "name" (aget userComponents 2)))
+
+(relationship pedro sergio are: %friends)
+(relationship pedro sergio has: %reports)
+(def rels (relationshipTypes))
+(assert (== 2 (len rels)))
+(assert (== "friends" (aget rels 0)))
+
+(assert (>= (hget (storageStats) %lsmSize) 0))
+
+true
@@ -8,10 +8,11 @@
      (fn [e]
         (hset e %name (concat "new: " (hget e %name ""))) e))
 
-(def updateCount
+(def updated
      (update boilerplate: updateBoilerplate queryBoilerplate))
 
-(assert (== 3 updateCount))
+(assert (== 3 (hget updated %done)))
+(assert (== 3 (hget updated %total)))
 
 (def newe1 (select boilerplate: (fn [e] (== "new: e1" (hget e %name)))))
 (assert (== 1 (len newe1)))
@@ -0,0 +1 @@
+(hash label: "cat")
@@ -0,0 +1,4 @@
+// maxAttempts: 2
+// backoff: 10ms
+
+(assert false)
@@ -0,0 +1,3 @@
+// fan in of the resize and annotate workflow steps
+(hash width: (hget (hget results %resize) %width)
+      label: (hget (hget results %annotate) %label))
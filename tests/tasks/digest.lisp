@@ -0,0 +1,3 @@
+// cron: 0 11 * * *
+
+(setCache %digest 0 (msgpack (hash at: scheduledAt)))
@@ -0,0 +1,3 @@
+(def data (unmsgpack msg))
+
+(hash doubled: (* 2 (hget data %value)))
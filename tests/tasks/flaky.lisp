@@ -0,0 +1,6 @@
+// maxAttempts: 2
+// backoff: 10ms
+
+// fails until its second attempt
+(assert (> attempts 1))
+(setCache %flaky 0 msg)
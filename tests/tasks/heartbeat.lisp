@@ -0,0 +1,3 @@
+// cron: @every 50ms
+
+(setCache %heartbeat 0 (msgpack (hash at: scheduledAt)))
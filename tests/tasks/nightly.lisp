@@ -0,0 +1,4 @@
+// cron: 30 3 * * 1-5
+// missed: once
+
+(setCache %nightly 0 (msgpack (hash at: scheduledAt)))
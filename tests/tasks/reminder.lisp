@@ -0,0 +1 @@
+(setCache %reminder 0 msg)
@@ -0,0 +1,3 @@
+(def data (unmsgpack msg))
+
+(hash width: (* 2 (hget data %width)))
@@ -0,0 +1,7 @@
+// stream: orders
+// maxAttempts: 2
+// backoff: 10ms
+
+(def order (unmsgpack msg))
+(assert (not (hget order %poison false)))
+(appendStream %tallied (msgpack (hash offset: offset total: (hget order %total))))
@@ -0,0 +1,4 @@
+// concurrency: 1
+// rate: 2
+
+(setCache %throttled 0 msg)
@@ -0,0 +1,6 @@
+// maxAttempts: 2
+// backoff: 10ms
+
+// fails its first attempt, retried apart from the welcome handler
+(assert (> attempts 1))
+(setCache %audit 0 msg)
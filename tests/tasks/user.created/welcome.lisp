@@ -0,0 +1 @@
+(setCache %welcome 0 msg)
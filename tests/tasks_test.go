@@ -2,12 +2,18 @@ package tests
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/glycerine/zygomys/v9/zygo"
 	"github.com/seapvnk/qokl/core"
 	"github.com/seapvnk/qokl/server"
 	"github.com/seapvnk/qokl/tasks"
@@ -24,9 +30,9 @@ func setupTestTask(t *testing.T) (http.Handler, *tasks.Listener) {
 func TestPeformTaskAndSaveCache(t *testing.T) {
 	core.OpenStore()
 	router, listener := setupTestTask(t)
+	defer core.CloseStore()
 	go listener.Run()
 	defer listener.Close()
-	defer core.CloseStore()
 
 	// send a request to dispatch a task that will store the cache
 	payload := `{"value": "it works"}`
@@ -61,3 +67,718 @@ func TestPeformTaskAndSaveCache(t *testing.T) {
 		t.Errorf("Expected response to contain %q, got %q", expected, resp.Body.String())
 	}
 }
+
+// Checks if a persistent core store keeps the cache and queues again jobs left in flight
+func TestPersistentStoreRecoversInflightJobs(t *testing.T) {
+	t.Setenv("QOKL_CORE_STORE", t.TempDir())
+
+	core.OpenStore()
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`
+		(setCache %greeting 0 (msgpack (hash value: "hello")))
+		(dispatch jobs: (msgpack (hash value: "job")))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	// reserved but never acked, as if the process crashed while handling it
+	job, err := core.StoreReserve("jobs")
+	if err != nil {
+		t.Fatalf("reserve failed: %v", err)
+	}
+	core.CloseStore()
+
+	core.OpenStore()
+	defer core.CloseStore()
+
+	recovered, err := core.StoreReserve("jobs")
+	if err != nil {
+		t.Fatalf("Expected the in-flight job to be queued again: %v", err)
+	}
+
+	if !bytes.Equal(recovered.Msg, job.Msg) {
+		t.Errorf("Expected the same message, got %q", recovered.Msg)
+	}
+
+	if err := core.StoreAck(recovered); err != nil {
+		t.Fatalf("ack failed: %v", err)
+	}
+
+	if _, err := core.StoreReserve("jobs"); err == nil {
+		t.Errorf("Expected the queue to be empty after the ack")
+	}
+
+	result, err = core.NewVM().UseStoreModule().ExecuteString(`(hget (unmsgpack (getCache %greeting)) %value)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("cache lookup failed: %v %v", err, result.Error)
+	}
+
+	if value, ok := result.Value.(*zygo.SexpStr); !ok || value.S != "hello" {
+		t.Errorf("Expected the cache to survive a restart, got %v", result.Value)
+	}
+}
+
+// Checks if failed jobs are retried and end up as dead letters once out of attempts
+func TestTaskRetriesAndDeadLetters(t *testing.T) {
+	core.OpenStore()
+	_, listener := setupTestTask(t)
+	defer core.CloseStore()
+	go listener.Run()
+	defer listener.Close()
+
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`
+		(dispatch flaky: (msgpack (hash value: "retried")))
+		(dispatch broken: (msgpack (hash value: "dead")))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	result, err = core.NewVM().UseStoreModule().ExecuteString(`(hget (unmsgpack (getCache %flaky)) %value)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("cache lookup failed: %v %v", err, result.Error)
+	}
+
+	if value, ok := result.Value.(*zygo.SexpStr); !ok || value.S != "retried" {
+		t.Errorf("Expected the flaky job to succeed on retry, got %v", result.Value)
+	}
+
+	dead, err := core.StoreDeadLetters("broken")
+	if err != nil {
+		t.Fatalf("dead letters failed: %v", err)
+	}
+
+	if len(dead) != 1 || dead[0].Attempts != 2 || dead[0].LastError == "" {
+		t.Fatalf("Expected one dead letter after 2 attempts, got %+v", dead)
+	}
+
+	if replayed, err := core.StoreReplay("broken"); err != nil || replayed != 1 {
+		t.Errorf("Expected to replay one dead letter, got %d %v", replayed, err)
+	}
+}
+
+// Checks if scheduled jobs reach their queue only once due
+func TestDelayedDispatch(t *testing.T) {
+	core.OpenStore()
+	_, listener := setupTestTask(t)
+	defer core.CloseStore()
+	go listener.Run()
+	defer listener.Close()
+
+	reminder := `(hget (unmsgpack (getCache %reminder)) %value)`
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`(dispatchIn reminder: 0.2 (msgpack (hash value: "later")))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if result, _ := core.NewVM().UseStoreModule().ExecuteString(reminder); result.Error == nil {
+		t.Errorf("Expected the reminder not to run yet, got %v", result.Value)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	result, err = core.NewVM().UseStoreModule().ExecuteString(reminder)
+	if err != nil || result.Error != nil {
+		t.Fatalf("Expected the reminder to run: %v %v", err, result.Error)
+	}
+
+	if value, ok := result.Value.(*zygo.SexpStr); !ok || value.S != "later" {
+		t.Errorf("Expected the scheduled message, got %v", result.Value)
+	}
+
+	result, err = core.NewVM().UseStoreModule().ExecuteString(`(dispatchAt reminder: "2000-01-01T00:00:00Z" (msgpack (hash value: "overdue")))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	result, _ = core.NewVM().UseStoreModule().ExecuteString(reminder)
+	if value, ok := result.Value.(*zygo.SexpStr); !ok || value.S != "overdue" {
+		t.Errorf("Expected an overdue message to run right away, got %v", result.Value)
+	}
+}
+
+// Checks if cron scheduled tasks are triggered by the listener
+func TestCronTask(t *testing.T) {
+	core.OpenStore()
+	_, listener := setupTestTask(t)
+	defer core.CloseStore()
+	go listener.Run()
+	defer listener.Close()
+
+	time.Sleep(300 * time.Millisecond)
+
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`(hget (unmsgpack (getCache %heartbeat)) %at)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("Expected the heartbeat to run: %v %v", err, result.Error)
+	}
+
+	if at, ok := result.Value.(*zygo.SexpStr); !ok || at.S == "" {
+		t.Errorf("Expected the scheduled time of the run, got %v", result.Value)
+	}
+}
+
+// Checks if the next runs of cron expressions are listed
+func TestCronSchedules(t *testing.T) {
+	// a friday
+	now := time.Date(2026, time.October, 16, 12, 0, 0, 0, time.Local)
+	schedules, err := tasks.Schedules("./", now)
+	if err != nil {
+		t.Fatalf("schedules failed: %v", err)
+	}
+
+	var nightly *tasks.Schedule
+	for i := range schedules {
+		if schedules[i].Task == "nightly" {
+			nightly = &schedules[i]
+		}
+	}
+
+	if nightly == nil || len(nightly.Next) != 5 {
+		t.Fatalf("Expected 5 runs of the nightly task, got %+v", schedules)
+	}
+
+	expected := []time.Time{
+		time.Date(2026, time.October, 19, 3, 30, 0, 0, time.Local),
+		time.Date(2026, time.October, 20, 3, 30, 0, 0, time.Local),
+	}
+	for i, run := range expected {
+		if !nightly.Next[i].Equal(run) {
+			t.Errorf("Expected run %d at %s, got %s", i, run, nightly.Next[i])
+		}
+	}
+}
+
+// Checks if urgent jobs are served before bulk ones of the same queue
+func TestQueuePriorities(t *testing.T) {
+	core.OpenStore()
+	defer core.CloseStore()
+
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`
+		(dispatch mails: (msgpack (hash value: "bulk")))
+		(dispatch mails: (msgpack (hash value: "newsletter")) priority: -5)
+		(dispatch mails: (msgpack (hash value: "urgent")) priority: 10)
+		(dispatchIn mails: 0 (msgpack (hash value: "later")) priority: 20)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	if _, err := core.StorePromoteDue(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("promote failed: %v", err)
+	}
+
+	for _, expected := range []string{"later", "urgent", "bulk", "newsletter"} {
+		msg, err := core.StoreDequeue("mails")
+		if err != nil {
+			t.Fatalf("Expected %q, queue is empty: %v", expected, err)
+		}
+
+		if !bytes.Contains(msg, []byte(expected)) {
+			t.Errorf("Expected %q, got %q", expected, msg)
+		}
+	}
+
+	if _, err := core.StoreDequeue("mails"); err == nil {
+		t.Errorf("Expected the queue to be empty")
+	}
+}
+
+// Checks if a queue starts no more jobs per second than the rate of its task
+func TestRateLimitedTask(t *testing.T) {
+	core.OpenStore()
+	defer core.CloseStore()
+
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`
+		(dispatch throttled: (msgpack (hash value: 1)))
+		(dispatch throttled: (msgpack (hash value: 2)))
+		(dispatch throttled: (msgpack (hash value: 3)))
+		(dispatch throttled: (msgpack (hash value: 4)))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	_, listener := setupTestTask(t)
+	go listener.Run()
+	defer listener.Close()
+
+	// a burst of 2 jobs, then one every 500ms
+	time.Sleep(200 * time.Millisecond)
+	if info, _ := core.StoreQueueInfo("throttled"); info.Length != 2 {
+		t.Errorf("Expected 2 jobs still waiting, got %d", info.Length)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if info, _ := core.StoreQueueInfo("throttled"); info.Length != 1 {
+		t.Errorf("Expected 1 job still waiting, got %d", info.Length)
+	}
+}
+
+// Checks if an idle listener is woken up by a dispatch instead of waiting for its next scan
+func TestDispatchWakesListener(t *testing.T) {
+	core.OpenStore()
+	defer core.CloseStore()
+	_, listener := setupTestTask(t)
+	go listener.Run()
+	defer listener.Close()
+
+	// let the listener go idle
+	time.Sleep(50 * time.Millisecond)
+
+	vm := core.NewVM().UseStoreModule()
+	result, err := vm.ExecuteString(`(dispatch usecache: (msgpack (hash value: "awake")))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	result, err = vm.ExecuteString(`(hget (unmsgpack (getCache %myData)) %data)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("Expected the job to run: %v %v", err, result.Error)
+	}
+
+	if data, ok := result.Value.(*zygo.SexpStr); !ok || data.S != "awake" {
+		t.Errorf("Expected the dispatched value, got %v", result.Value)
+	}
+}
+
+// Checks if dispatch returns a job id whose status and result can be polled
+func TestJobStatus(t *testing.T) {
+	core.OpenStore()
+	router, listener := setupTestTask(t)
+	defer core.CloseStore()
+
+	vm := core.NewVM().UseStoreModule()
+	result, err := vm.ExecuteString(`(dispatch double: (msgpack (hash value: 21)))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	id, ok := result.Value.(*zygo.SexpStr)
+	if !ok || id.S == "" {
+		t.Fatalf("Expected dispatch to return a job id, got %v", result.Value)
+	}
+
+	result, err = vm.ExecuteString(`(hget (jobStatus "` + id.S + `") %status)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("jobStatus failed: %v %v", err, result.Error)
+	}
+
+	if status, ok := result.Value.(*zygo.SexpStr); !ok || status.S != core.JobQueued {
+		t.Errorf("Expected the job to be queued, got %v", result.Value)
+	}
+
+	go listener.Run()
+	defer listener.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// clients poll with the job id alone, even when admin routes require a token
+	t.Setenv("QOKL_ADMIN_TOKEN", adminToken)
+	req := httptest.NewRequest("GET", "/jobs/"+id.S, nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 OK, got %d", resp.Code)
+	}
+
+	var status struct {
+		Status     string         `json:"status"`
+		Attempts   int            `json:"attempts"`
+		Result     map[string]any `json:"result"`
+		FinishedAt *time.Time     `json:"finishedAt"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Cannot decode: %v", err)
+	}
+
+	if status.Status != core.JobSucceeded || status.Attempts != 1 || status.Result["doubled"] != 42.0 || status.FinishedAt == nil {
+		t.Errorf("Expected the job to succeed with its result, got %+v", status)
+	}
+
+	req = httptest.NewRequest("GET", "/jobs/unknown", nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown job, got %d", resp.Code)
+	}
+}
+
+// Checks if workflow steps fan out and in with results passed between them, and if a failed step skips the ones waiting for it
+func TestWorkflow(t *testing.T) {
+	core.OpenStore()
+	router, listener := setupTestTask(t)
+	defer core.CloseStore()
+	go listener.Run()
+	defer listener.Close()
+
+	vm := core.NewVM().UseStoreModule()
+	result, err := vm.ExecuteString(`
+		(def input (msgpack (hash width: 100)))
+		(def ok (startWorkflow [(hash name: %resize)
+		                        (hash name: %annotate after: [%resize])
+		                        (hash name: %combine after: [%resize %annotate])]
+		                       input))
+		(def failing (startWorkflow [(hash name: %resize)
+		                             (hash name: %broken after: [%resize])
+		                             (hash name: %combine after: [%broken])]
+		                            input))
+		[ok failing]`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("startWorkflow failed: %v %v", err, result.Error)
+	}
+
+	ids := result.Value.(*zygo.SexpArray).Val
+	time.Sleep(300 * time.Millisecond)
+
+	req := httptest.NewRequest("GET", "/workflows/"+ids[0].(*zygo.SexpStr).S, nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var workflow struct {
+		Status string         `json:"status"`
+		Input  map[string]any `json:"input"`
+		Steps  []struct {
+			Name   string         `json:"name"`
+			Status string         `json:"status"`
+			Result map[string]any `json:"result"`
+		} `json:"steps"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&workflow); err != nil {
+		t.Fatalf("Cannot decode: %v", err)
+	}
+
+	if workflow.Status != core.WorkflowSucceeded || workflow.Input["width"] == nil {
+		t.Fatalf("Expected the workflow to succeed, got %+v", workflow)
+	}
+
+	combined := workflow.Steps[2].Result
+	if combined["width"] != 200.0 || combined["label"] != "cat" {
+		t.Errorf("Expected the combine step to see the results of the others, got %v", combined)
+	}
+
+	result, err = vm.ExecuteString(`(def status (workflowStatus "` + ids[1].(*zygo.SexpStr).S + `"))
+		[(hget status %status) (hget (hget (hget status %steps) %combine) %status)]`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("workflowStatus failed: %v %v", err, result.Error)
+	}
+
+	statuses := result.Value.(*zygo.SexpArray).Val
+	if statuses[0].(*zygo.SexpStr).S != core.WorkflowFailed || statuses[1].(*zygo.SexpStr).S != core.StepSkipped {
+		t.Errorf("Expected the workflow to fail and skip the step after the failure, got %v", result.Value)
+	}
+
+	result, _ = vm.ExecuteString(`(startWorkflow [(hash name: %a after: [%b]) (hash name: %b after: [%a])] input)`)
+	if result.Error == nil {
+		t.Errorf("Expected a cycle between steps to be rejected")
+	}
+}
+
+// Checks if a published message is handled by every task subscribed to its topic
+func TestPublishTopic(t *testing.T) {
+	core.OpenStore()
+	_, listener := setupTestTask(t)
+	defer core.CloseStore()
+	go listener.Run()
+	defer listener.Close()
+
+	// let the listener subscribe the handlers
+	time.Sleep(50 * time.Millisecond)
+
+	vm := core.NewVM().UseStoreModule()
+	result, err := vm.ExecuteString(`
+		(def ids (publish user.created: (msgpack (hash name: "Ana"))))
+		(publish nobody.listens: (msgpack (hash name: "Ana")))
+		[(len ids) (subscribers user.created:)]`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("publish failed: %v %v", err, result.Error)
+	}
+
+	published := result.Value.(*zygo.SexpArray).Val
+	if count, ok := published[0].(*zygo.SexpInt); !ok || count.Val != 2 {
+		t.Errorf("Expected 2 subscribed handlers, got %v", result.Value)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	for _, key := range []string{"welcome", "audit"} {
+		result, err := vm.ExecuteString(`(hget (unmsgpack (getCache %` + key + `)) %name)`)
+		if err != nil || result.Error != nil {
+			t.Fatalf("Expected the %s handler to run: %v %v", key, err, result.Error)
+		}
+
+		if name, ok := result.Value.(*zygo.SexpStr); !ok || name.S != "Ana" {
+			t.Errorf("Expected the %s handler to get the message, got %v", key, result.Value)
+		}
+	}
+
+	queues, err := core.StoreQueues()
+	names := []string{}
+	for _, queue := range queues {
+		names = append(names, queue.Name)
+	}
+
+	if err != nil || !slices.Contains(names, "user.created/audit") || !slices.Contains(names, "user.created/welcome") {
+		t.Errorf("Expected a queue per handler, got %v %v", names, err)
+	}
+}
+
+// Checks if stream records are kept after reading, and consumed in order by a task and its group
+func TestStreamConsumers(t *testing.T) {
+	core.OpenStore()
+	_, listener := setupTestTask(t)
+	defer core.CloseStore()
+
+	vm := core.NewVM().UseStoreModule()
+	result, err := vm.ExecuteString(`
+		(appendStream %orders (msgpack (hash total: 10)))
+		(appendStream %orders (msgpack (hash poison: true)))
+		(appendStream %orders (msgpack (hash total: 30)))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("appendStream failed: %v %v", err, result.Error)
+	}
+
+	if offset, ok := result.Value.(*zygo.SexpInt); !ok || offset.Val != 2 {
+		t.Errorf("Expected the third record at offset 2, got %v", result.Value)
+	}
+
+	for range 2 {
+		records, err := core.StoreReadStream("orders", 1, 10)
+		if err != nil || len(records) != 2 || records[0].Offset != 1 {
+			t.Fatalf("Expected to read the records from offset 1 twice, got %+v %v", records, err)
+		}
+	}
+
+	go listener.Run()
+	defer listener.Close()
+
+	// the poisoned record fails both attempts and is skipped
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		position, err := core.StoreGroup("orders", "tally")
+		if err == nil && position.Offset == 3 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the tally group to reach offset 3, got %+v %v", position, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tallied, err := core.StoreReadStream("tallied", 0, 10)
+	if err != nil || len(tallied) != 2 {
+		t.Fatalf("Expected 2 tallied records, got %+v %v", tallied, err)
+	}
+
+	for i, offset := range []uint64{0, 2} {
+		value, err := zygo.MsgpackToGo(tallied[i].Msg)
+		if err != nil || value.(map[string]any)["offset"] != int64(offset) {
+			t.Errorf("Expected the record at offset %d to be tallied, got %v %v", offset, value, err)
+		}
+	}
+
+	// retention drops the oldest records, new groups start at the first one kept
+	result, err = vm.ExecuteString(`
+		(retainStream %orders maxLength: 2)
+		(appendStream %orders (msgpack (hash total: 40)))
+		(hget (first (readGroup %orders %audit)) %offset)`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("retention failed: %v %v", err, result.Error)
+	}
+
+	if offset, ok := result.Value.(*zygo.SexpInt); !ok || offset.Val != 2 {
+		t.Errorf("Expected a new group to start at offset 2, got %v", result.Value)
+	}
+
+	info, err := core.StoreStreamInfo("orders")
+	if err != nil || info.First != 2 || info.Next != 4 || info.Length != 2 {
+		t.Errorf("Expected offsets 2 to 3 to be kept, got %+v %v", info, err)
+	}
+}
+
+// Checks if cron runs on the hour are found in zones with a half hour offset
+func TestCronSchedulesInHalfHourZone(t *testing.T) {
+	kolkata := time.FixedZone("IST", 5*3600+30*60)
+	now := time.Date(2026, time.October, 16, 12, 0, 0, 0, kolkata)
+	schedules, err := tasks.Schedules("./", now)
+	if err != nil {
+		t.Fatalf("schedules failed: %v", err)
+	}
+
+	for _, schedule := range schedules {
+		if schedule.Task != "digest" {
+			continue
+		}
+
+		expected := time.Date(2026, time.October, 17, 11, 0, 0, 0, kolkata)
+		if len(schedule.Next) != 5 || !schedule.Next[0].Equal(expected) {
+			t.Errorf("Expected the digest to run at %s, got %v", expected, schedule.Next)
+		}
+		return
+	}
+
+	t.Fatalf("Expected a schedule for the digest task, got %+v", schedules)
+}
+
+// Checks if the queue of a task with an invalid config is not served
+func TestInvalidTaskConfigIsNotServed(t *testing.T) {
+	baseDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(baseDir, "tasks"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	task := "// maxAttempts: 0\n\n(hash done: true)\n"
+	if err := os.WriteFile(filepath.Join(baseDir, "tasks", "misconfigured.lisp"), []byte(task), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	core.OpenStore()
+	defer core.CloseStore()
+	listener := tasks.New(baseDir)
+
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`(dispatch misconfigured: (msgpack (hash value: 1)))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	go listener.Run()
+	defer listener.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	info, err := core.StoreQueueInfo("misconfigured")
+	if err != nil || info.Length != 1 || info.Inflight != 0 || info.Dead != 0 {
+		t.Errorf("Expected the job to wait in its queue, got %+v %v", info, err)
+	}
+}
+
+// Checks if dead letters of a queue whose name extends another are kept apart
+func TestDeadLettersOfNestedQueueNames(t *testing.T) {
+	core.OpenStore()
+	defer core.CloseStore()
+
+	for _, queueName := range []string{"user", "user.created/audit"} {
+		result, err := core.NewVM().UseStoreModule().ExecuteString(`(dispatch (str2sym "` + queueName + `") (msgpack (hash value: 1)))`)
+		if err != nil || result.Error != nil {
+			t.Fatalf("dispatch failed: %v %v", err, result.Error)
+		}
+
+		job, err := core.StoreReserve(queueName)
+		if err != nil {
+			t.Fatalf("reserve failed: %v", err)
+		}
+
+		if err := core.StoreFail(job, errors.New("gave up"), 1, 0); err != nil {
+			t.Fatalf("fail failed: %v", err)
+		}
+	}
+
+	if dead, err := core.StoreDeadLetters("user"); err != nil || len(dead) != 1 {
+		t.Errorf("Expected one dead letter of user, got %+v %v", dead, err)
+	}
+
+	if info, err := core.StoreQueueInfo("user"); err != nil || info.Dead != 1 {
+		t.Errorf("Expected user to count one dead letter, got %+v %v", info, err)
+	}
+
+	if replayed, err := core.StoreReplay("user"); err != nil || replayed != 1 {
+		t.Errorf("Expected to replay only the dead letter of user, got %d %v", replayed, err)
+	}
+
+	if dead, err := core.StoreDeadLetters("user.created/audit"); err != nil || len(dead) != 1 {
+		t.Errorf("Expected the dead letter of user.created/audit to stay, got %+v %v", dead, err)
+	}
+}
+
+// Checks if a task file added while the listener runs is discovered
+func TestNewTaskFileIsDiscovered(t *testing.T) {
+	baseDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(baseDir, "tasks"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	core.OpenStore()
+	defer core.CloseStore()
+	listener := tasks.New(baseDir)
+	go listener.Run()
+	defer listener.Close()
+
+	result, err := core.NewVM().UseStoreModule().ExecuteString(`(dispatch added: (msgpack (hash value: 1)))`)
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(baseDir, "tasks", "added.lisp"), []byte("(hash done: true)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		info, err := core.StoreQueueInfo("added")
+		if err == nil && info.Length == 0 && info.Inflight == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the job of the new task to run, got %+v %v", info, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Checks if backlogs larger than a transaction are recovered, promoted and replayed whole
+func TestLargeBacklogsAreBatched(t *testing.T) {
+	t.Setenv("QOKL_CORE_STORE", t.TempDir())
+
+	core.OpenStore()
+	result, err := core.NewVM().UseStoreModule().ExecuteString(
+		strings.Repeat(`(dispatch backlog: (msgpack (hash value: "job")))`, 700) +
+			strings.Repeat(`(dispatchIn later: 0.05 (msgpack (hash value: "later")))`, 600))
+	if err != nil || result.Error != nil {
+		t.Fatalf("dispatch failed: %v %v", err, result.Error)
+	}
+
+	for range 600 {
+		if _, err := core.StoreReserve("backlog"); err != nil {
+			t.Fatalf("reserve failed: %v", err)
+		}
+	}
+
+	if _, err := core.StoreLease("backlog", time.Minute, 1); err != nil {
+		t.Fatalf("lease failed: %v", err)
+	}
+	core.CloseStore()
+
+	core.OpenStore()
+	defer core.CloseStore()
+
+	info, err := core.StoreQueueInfo("backlog")
+	if err != nil || info.Length != 699 || info.Inflight != 1 {
+		t.Errorf("Expected 699 jobs queued again and the leased one in flight, got %+v %v", info, err)
+	}
+
+	promoted, err := core.StorePromoteDue(time.Now().Add(time.Second))
+	if err != nil || promoted != 600 {
+		t.Fatalf("Expected 600 promoted messages, got %d %v", promoted, err)
+	}
+
+	for range 600 {
+		job, err := core.StoreReserve("later")
+		if err != nil {
+			t.Fatalf("reserve failed: %v", err)
+		}
+
+		if err := core.StoreFail(job, errors.New("boom"), 1, 0); err != nil {
+			t.Fatalf("fail failed: %v", err)
+		}
+	}
+
+	replayed, err := core.StoreReplay("later")
+	if err != nil || replayed != 600 {
+		t.Errorf("Expected 600 replayed dead letters, got %d %v", replayed, err)
+	}
+
+	if info, err := core.StoreQueueInfo("later"); err != nil || info.Length != 600 || info.Dead != 0 {
+		t.Errorf("Expected the replayed jobs queued, got %+v %v", info, err)
+	}
+}